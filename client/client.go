@@ -4,7 +4,6 @@ package client
 
 import (
 	"bytes"
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,6 +11,9 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/user"
+	"strings"
+	"time"
 
 	"github.com/johnietre/gossh/common"
 	utils "github.com/johnietre/utils/go"
@@ -21,6 +23,7 @@ import (
 )
 
 var (
+	username          string
 	password          []byte
 	useHttp, insecure bool
 )
@@ -33,8 +36,24 @@ func GetCmd() *cobra.Command {
 		Aliases: []string{"c"},
 		//Run: runClient,
 	}
-	cmd.AddCommand(getSshCmd(), getProcsCmd())
+	cmd.AddCommand(
+		getSshCmd(),
+		getExecCmd(),
+		getForwardCmd(),
+		getProxyCmd(),
+		getProcsCmd(),
+		getSessionsCmd(),
+		getRecordingsCmd(),
+		getReplayCmd(),
+	)
 	psflags := cmd.PersistentFlags()
+	psflags.StringVarP(
+		&username, "user", "u", defaultUsername(),
+		fmt.Sprintf(
+			"User to log in as (defaults to value of %s environment variable or current user)",
+			common.UserEnvName,
+		),
+	)
 	psflags.BoolVar(
 		&envPwd, "envpwd", false,
 		fmt.Sprintf(
@@ -57,10 +76,21 @@ var (
 	envPwd bool
 )
 
-func getPassword() (pwd []byte, err error) {
+func defaultUsername() string {
+	if name := os.Getenv(common.UserEnvName); name != "" {
+		return name
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
+
+func getPassword(addr string) (pwd []byte, err error) {
 	if envPwd {
 		pwd = []byte(os.Getenv(common.PasswordEnvName))
 	} else {
+		showBanner(addr)
 		fmt.Print("Password: ")
 		pwd, err = term.ReadPassword(int(os.Stdin.Fd()))
 		fmt.Println()
@@ -72,6 +102,57 @@ func getPassword() (pwd []byte, err error) {
 	return
 }
 
+var bannerShown bool
+
+// bannerTimeout is how long to wait for the banner, which older servers don't
+// send.
+const bannerTimeout = time.Second * 2
+
+// showBanner prints the server's pre-auth banner, if it has one, the first
+// time it's called.
+func showBanner(addr string) {
+	if bannerShown {
+		return
+	}
+	bannerShown = true
+	// Remove any path (e.g., ws/ssh)
+	addr, _, _ = strings.Cut(addr, "/")
+	banner, err := getBanner(addr)
+	if err != nil || banner == "" {
+		return
+	}
+	fmt.Fprint(os.Stderr, banner)
+	if !strings.HasSuffix(banner, "\n") {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+func getBanner(addr string) (string, error) {
+	if useHttp {
+		client := &http.Client{Timeout: bannerTimeout}
+		resp, err := client.Do(newReq(http.MethodGet, addr+"/banner", nil))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("received status %s", resp.Status)
+		}
+		b, err := io.ReadAll(resp.Body)
+		return string(b), err
+	}
+	conn, err := net.DialTimeout("tcp", addr, bannerTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(bannerTimeout))
+	if _, err := utils.WriteAll(conn, common.TcpInitial(common.TcpBanner)); err != nil {
+		return "", err
+	}
+	return common.ReadStr16(conn)
+}
+
 func handlePasswordErr(pwd []byte, err error) []byte {
 	if err != nil {
 		log.Fatal("Error reading password: ", err)
@@ -79,6 +160,8 @@ func handlePasswordErr(pwd []byte, err error) []byte {
 	return pwd
 }
 
+const dialTimeout = time.Second * 10
+
 func dialConn(addr string, what byte) (net.Conn, error) {
 	if useHttp {
 		if insecure {
@@ -86,9 +169,14 @@ func dialConn(addr string, what byte) (net.Conn, error) {
 		} else {
 			addr = "wss://" + addr
 		}
-		return webs.Dial(addr, "", "http://localhost/")
+		config, err := webs.NewConfig(addr, "http://localhost/")
+		if err != nil {
+			return nil, err
+		}
+		config.Dialer = &net.Dialer{Timeout: dialTimeout}
+		return webs.DialConfig(config)
 	}
-	conn, err := net.Dial("tcp", addr)
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
 	if err != nil {
 		return nil, err
 	}
@@ -110,6 +198,7 @@ func newReq(method string, urlStr string, body io.Reader) *http.Request {
 	if err != nil {
 		log.Fatal("Error creating request: ", err)
 	}
+	req.Header.Set(common.HttpUserHeader, username)
 	req.Header.Set(common.HttpPasswordHeader, string(password))
 	return req
 }
@@ -118,38 +207,35 @@ func sendPassword(conn net.Conn, pwd []byte) error {
 	if pwd == nil {
 		pwd = password
 	}
-	// Send password
-	if _, err := conn.Write([]byte{byte(len(pwd))}); err != nil {
-		return err
+	if len(username) > 255 {
+		return fmt.Errorf("username too long")
 	}
-	if _, err := utils.WriteAll(conn, pwd); err != nil {
+	// Send username and password
+	buf := append([]byte{byte(len(username))}, username...)
+	buf = append(append(buf, byte(len(pwd))), pwd...)
+	if _, err := utils.WriteAll(conn, buf); err != nil {
 		return err
 	}
 	// Check password response
-	var buf [1]byte
-	if _, err := conn.Read(buf[:]); err != nil {
-		return err
-	}
-	switch buf[0] {
-	case common.RespOk:
-		return nil
-	case common.RespErrPasswordInvalid:
-		return errIncorrectPassword
-	case common.RespErrPasswordError:
-		return fmt.Errorf("password server error")
-	default:
-		return fmt.Errorf("received unknown password response: %d", buf[0])
-	}
+	return common.ReadResp(conn)
 }
 
-func readErrResp(conn net.Conn) ([]byte, error) {
-	buf := make([]byte, 2)
-	if _, err := io.ReadFull(conn, buf); err != nil {
+// doReq sends the request, returning the response body or the error sent by
+// the server.
+func doReq(req *http.Request) ([]byte, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
 		return nil, err
 	}
-	buf = make([]byte, binary.LittleEndian.Uint16(buf))
-	_, err := io.ReadFull(conn, buf)
-	return buf, err
+	if resp.StatusCode != http.StatusOK {
+		return nil, common.DecodeHttpError(body, resp.StatusCode)
+	}
+	return body, nil
 }
 
 func encodeJsonBuf(v any) (*bytes.Buffer, error) {
@@ -160,10 +246,6 @@ func encodeJsonBuf(v any) (*bytes.Buffer, error) {
 	return bytes.NewBuffer(b), nil
 }
 
-var (
-	errIncorrectPassword = fmt.Errorf("password incorrect")
-)
-
 func must[T any](t T, err error) T {
 	if err != nil {
 		log.Fatal(err)
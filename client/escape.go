@@ -0,0 +1,137 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+var (
+	// The escape character, or -1 if escapes are disabled
+	escapeChar = int('~')
+)
+
+// parseEscapeChar parses a single character, a control character in the
+// format ^X, or "none".
+func parseEscapeChar(s string) (int, error) {
+	if s == "none" {
+		return -1, nil
+	} else if len(s) == 1 {
+		return int(s[0]), nil
+	} else if len(s) == 2 && s[0] == '^' {
+		return int(s[1] & 0x1f), nil
+	}
+	return 0, fmt.Errorf("invalid escape character %q", s)
+}
+
+func escapeCharStr() string {
+	if escapeChar < 0x20 {
+		return "^" + string(rune(escapeChar+'@'))
+	}
+	return string(rune(escapeChar))
+}
+
+// sshEscaper handles escape sequences typed at the start of a line, only when
+// stdin is a terminal.
+type sshEscaper struct {
+	sc *sshConn
+	// Whether the last character typed was a newline (or nothing has been typed)
+	lineStart bool
+	// Whether the escape character was typed and the next character is a
+	// command
+	escaped bool
+}
+
+func newSshEscaper(sc *sshConn) *sshEscaper {
+	return &sshEscaper{sc: sc, lineStart: true}
+}
+
+// filter handles any escape sequences, returning the input to send.
+func (se *sshEscaper) filter(p []byte) []byte {
+	if escapeChar < 0 || termState == nil {
+		return p
+	}
+	out := make([]byte, 0, len(p))
+	for _, b := range p {
+		if se.escaped {
+			// Commands that don't send anything leave the line start as is
+			se.escaped = false
+			switch b {
+			case '.':
+				se.sc.detach()
+				restoreTerm()
+				log.Print("\n===Disconnected===")
+				os.Exit(255)
+			case '?':
+				se.printHelp()
+			case 'Z' & 0x1f:
+				se.suspend()
+			case '#':
+				se.printForwardings()
+			case 'R':
+				requestResize()
+			case byte(escapeChar):
+				out = append(out, b)
+				se.lineStart = false
+			default:
+				out = append(out, byte(escapeChar), b)
+				se.lineStart = b == '\r' || b == '\n'
+			}
+			continue
+		}
+		if se.lineStart && int(b) == escapeChar {
+			se.escaped = true
+			continue
+		}
+		out = append(out, b)
+		se.lineStart = b == '\r' || b == '\n'
+	}
+	return out
+}
+
+func (se *sshEscaper) printHelp() {
+	e := escapeCharStr()
+	lines := []string{
+		"Supported escape sequences:",
+		" " + e + ".   - disconnect",
+		" " + e + "^Z  - suspend gossh",
+		" " + e + "#   - list forwarded connections",
+		" " + e + "R   - resend the terminal size",
+		" " + e + "?   - this message",
+		" " + e + e + "   - send the escape character by typing it twice",
+		"(Note that escapes are only recognized immediately after newline.)",
+	}
+	os.Stdout.WriteString("\r\n" + strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func (se *sshEscaper) printForwardings() {
+	fwds := getForwardings()
+	if len(fwds) == 0 {
+		os.Stdout.WriteString("\r\nNo forwarded connections\r\n")
+		return
+	}
+	os.Stdout.WriteString(
+		"\r\nForwarded connections:\r\n  " + strings.Join(fwds, "\r\n  ") + "\r\n",
+	)
+}
+
+// suspend restores the terminal and stops the process, setting the terminal
+// back to raw mode once continued.
+func (se *sshEscaper) suspend() {
+	os.Stdout.WriteString("\r\n")
+	restoreTerm()
+	syscall.Kill(os.Getpid(), syscall.SIGTSTP)
+	// Continued
+	state, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		log.Print("Error setting terminal: ", err)
+		return
+	}
+	termState = state
+	// The terminal may have been resized while suspended
+	requestResize()
+}
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+
+	"github.com/johnietre/gossh/common"
+	utils "github.com/johnietre/utils/go"
+	"github.com/spf13/cobra"
+)
+
+func getExecCmd() *cobra.Command {
+	var dir string
+	cmd := &cobra.Command{
+		Use:   "exec <ADDR> [--] <CMD> [ARGS...]",
+		Short: "Run a command remotely without a terminal",
+		Long:  "Run a command on the gossh server without allocating a pty. Stdin is forwarded to the command (until EOF), stdout and stderr are kept separate, and the client exits with the command's exit code.",
+		Args:  cobra.MinimumNArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			addr, args := args[0], args[1:]
+			// Flags aren't parsed after the address, so "--" is left in the args
+			if args[0] == "--" {
+				args = args[1:]
+			}
+			if len(args) == 0 {
+				log.Fatal("Missing command")
+			}
+			if useHttp {
+				addr = path.Join(addr, "ws/ssh")
+			}
+			req := common.ExecReq{
+				Command: args,
+				Env:     getReqEnv(cmd.Flags(), false),
+				Dir:     dir,
+			}
+			os.Exit(runExec(addr, req))
+		},
+	}
+	// Allow flags to be passed to the remote command without "--"
+	cmd.Flags().SetInterspersed(false)
+	addEnvFlags(cmd.Flags(), &dir)
+	return cmd
+}
+
+// runExec runs the command and returns the exit code to exit with.
+func runExec(addr string, req common.ExecReq) int {
+	conn, err := connectConn(addr)
+	if err != nil {
+		log.Fatal("Error connecting: ", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{common.HeaderExecSsh}); err != nil {
+		log.Fatal("Error sending request: ", err)
+	}
+	if err := common.WriteJsonFrame(conn, req); err != nil {
+		log.Fatal("Error sending request: ", err)
+	}
+	if err := common.ReadResp(conn); err != nil {
+		log.Fatal("Error executing command: ", err)
+	}
+
+	ew := &execWriter{conn: conn}
+	forwardSignals(func(sig syscall.Signal) {
+		ew.writeFrame(common.ExecSignal, []byte{byte(sig)})
+	})
+	go execStdinToConn(ew)
+	for {
+		typ, data, err := common.ReadExecFrame(conn)
+		if err != nil {
+			if err == io.EOF {
+				log.Print("Connection closed before command exited")
+			} else {
+				log.Print("Error reading: ", err)
+			}
+			return 255
+		}
+		switch typ {
+		case common.ExecStdout:
+			os.Stdout.Write(data)
+		case common.ExecStderr:
+			os.Stderr.Write(data)
+		case common.ExecExit:
+			es, err := common.ReadExitStatus(bytes.NewReader(data))
+			if err != nil {
+				log.Print("Error reading exit status: ", err)
+				return 255
+			}
+			if es.Signal != 0 {
+				log.Printf("Remote process %s", es)
+			}
+			return es.ExitCode()
+		}
+	}
+}
+
+func execStdinToConn(ew *execWriter) {
+	buf := make([]byte, 1<<15)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n != 0 {
+			if err := ew.writeFrame(common.ExecStdin, buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Print("Error reading stdin: ", err)
+			}
+			break
+		}
+	}
+	// An empty frame signals EOF
+	ew.writeFrame(common.ExecStdin, nil)
+}
+
+// execWriter writes exec frames to a connection.
+type execWriter struct {
+	conn net.Conn
+	mtx  sync.Mutex
+}
+
+func (ew *execWriter) writeFrame(typ byte, data []byte) error {
+	ew.mtx.Lock()
+	defer ew.mtx.Unlock()
+	_, err := utils.WriteAll(ew.conn, common.AppendExecFrame(nil, typ, data))
+	return err
+}
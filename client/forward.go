@@ -0,0 +1,335 @@
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnietre/gossh/common"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+func getForwardCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "forward <ADDR>",
+		Aliases: []string{"fwd"},
+		Short:   "Forward ports through the gossh server",
+		Long:    "Forward connections to local ports to hosts reachable from the gossh server (-L), or connections to ports on the server to hosts reachable from the client (-R). The server must allow forwarding to each target and listening on each remote bind address (see the server's --allow-forward and --allow-remote-forward flags). Over HTTP (websockets), half-closed connections aren't supported, so a connection is fully closed once either side stops sending.",
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			fwds := getForwardFlags(cmd.Flags())
+			if len(fwds.local) == 0 && len(fwds.remote) == 0 {
+				log.Fatal("No forwards specified")
+			}
+			password = handlePasswordErr(getPassword(args[0]))
+			gotPassword = true
+			log.Fatal(<-startForwards(args[0], fwds))
+		},
+	}
+	addLocalForwardFlag(cmd.Flags())
+	addRemoteForwardFlag(cmd.Flags())
+	return cmd
+}
+
+func addLocalForwardFlag(flags *pflag.FlagSet) {
+	flags.StringArrayP(
+		"local", "L", nil,
+		"Forward a local port to HOST:HOSTPORT from the server, in the format [BIND_ADDR:]PORT:HOST:HOSTPORT (BIND_ADDR defaults to localhost, * means all interfaces)",
+	)
+}
+
+func addRemoteForwardFlag(flags *pflag.FlagSet) {
+	flags.StringArrayP(
+		"remote", "R", nil,
+		"Forward a port on the server to HOST:HOSTPORT from the client, in the format [BIND_ADDR:]PORT:HOST:HOSTPORT (BIND_ADDR is on the server and follows the same rules as -L)",
+	)
+}
+
+func addDynamicForwardFlag(flags *pflag.FlagSet) {
+	flags.StringArrayP(
+		"dynamic", "D", nil,
+		"Local port to run a SOCKS5/HTTP CONNECT proxy on, in the format [BIND_ADDR:]PORT (BIND_ADDR defaults to localhost, * means all interfaces)",
+	)
+}
+
+// forwards holds the parsed forwarding flags.
+type forwards struct {
+	local, remote []forwardSpec
+	// Bind addresses for proxies
+	dynamic []string
+}
+
+func (f forwards) empty() bool {
+	return len(f.local) == 0 && len(f.remote) == 0 && len(f.dynamic) == 0
+}
+
+// getForwardFlags parses the forwarding flags that were added to the flag set.
+func getForwardFlags(flags *pflag.FlagSet) (fwds forwards) {
+	if flags.Lookup("local") != nil {
+		fwds.local = parseForwardSpecs(must(flags.GetStringArray("local")))
+	}
+	if flags.Lookup("remote") != nil {
+		fwds.remote = parseForwardSpecs(must(flags.GetStringArray("remote")))
+	}
+	if flags.Lookup("dynamic") != nil {
+		for _, spec := range must(flags.GetStringArray("dynamic")) {
+			bind, err := parseProxySpec(spec)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fwds.dynamic = append(fwds.dynamic, bind)
+		}
+	}
+	return
+}
+
+var (
+	// Descriptions of the active forwardings
+	forwardings    []string
+	forwardingsMtx sync.Mutex
+)
+
+func addForwarding(desc string) {
+	forwardingsMtx.Lock()
+	forwardings = append(forwardings, desc)
+	forwardingsMtx.Unlock()
+	log.Print(desc)
+}
+
+func removeForwarding(desc string) {
+	forwardingsMtx.Lock()
+	defer forwardingsMtx.Unlock()
+	for i, fwd := range forwardings {
+		if fwd == desc {
+			forwardings = append(forwardings[:i], forwardings[i+1:]...)
+			break
+		}
+	}
+}
+
+func getForwardings() []string {
+	forwardingsMtx.Lock()
+	defer forwardingsMtx.Unlock()
+	return append([]string(nil), forwardings...)
+}
+
+// startForwards starts the forwards and proxies through the server at addr,
+// returning a channel that receives errors that stop a forward or proxy. The
+// password must have already been read.
+func startForwards(addr string, fwds forwards) <-chan error {
+	if useHttp {
+		addr = path.Join(addr, "ws/forward")
+	}
+	errCh := make(chan error, len(fwds.local)+len(fwds.remote)+len(fwds.dynamic))
+	for _, fwd := range fwds.remote {
+		go func(fwd forwardSpec) {
+			errCh <- runRemoteForward(addr, fwd)
+		}(fwd)
+	}
+	for _, fwd := range fwds.local {
+		ln, err := net.Listen("tcp", fwd.bind)
+		if err != nil {
+			log.Fatal("Error listening: ", err)
+		}
+		addForwarding(fmt.Sprintf("Forwarding %s to %s", ln.Addr(), fwd.target))
+		go func(ln net.Listener, target string) {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					errCh <- fmt.Errorf("error accepting: %w", err)
+					return
+				}
+				go forwardLocalConn(addr, target, c)
+			}
+		}(ln, fwd.target)
+	}
+	for _, bind := range fwds.dynamic {
+		ln, err := net.Listen("tcp", bind)
+		if err != nil {
+			log.Fatal("Error listening: ", err)
+		}
+		addForwarding(fmt.Sprintf("Proxying on %s", ln.Addr()))
+		go func(ln net.Listener) {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					errCh <- fmt.Errorf("error accepting: %w", err)
+					return
+				}
+				go handleProxyConn(addr, c)
+			}
+		}(ln)
+	}
+	return errCh
+}
+
+type forwardSpec struct {
+	bind, target string
+}
+
+func parseForwardSpecs(specs []string) []forwardSpec {
+	fwds := make([]forwardSpec, len(specs))
+	for i, spec := range specs {
+		fwd, err := parseForwardSpec(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fwds[i] = fwd
+	}
+	return fwds
+}
+
+// parseForwardSpec parses a spec in the format [BIND_ADDR:]PORT:HOST:HOSTPORT.
+// IPv6 addresses must be enclosed in brackets.
+func parseForwardSpec(spec string) (fwd forwardSpec, err error) {
+	parts := splitForwardSpec(spec)
+	switch len(parts) {
+	case 3:
+		fwd.bind = net.JoinHostPort("localhost", parts[0])
+	case 4:
+		if parts[0] == "*" {
+			parts[0] = ""
+		}
+		fwd.bind = net.JoinHostPort(parts[0], parts[1])
+		parts = parts[1:]
+	default:
+		return fwd, fmt.Errorf("invalid forward %q", spec)
+	}
+	if parts[1] == "" || parts[2] == "" {
+		return fwd, fmt.Errorf("invalid forward %q", spec)
+	}
+	fwd.target = net.JoinHostPort(parts[1], parts[2])
+	return fwd, nil
+}
+
+// splitForwardSpec splits on colons outside of brackets, removing the
+// brackets.
+func splitForwardSpec(spec string) []string {
+	var parts []string
+	inBrackets, start := false, 0
+	for i, c := range spec {
+		switch c {
+		case '[':
+			inBrackets = true
+		case ']':
+			inBrackets = false
+		case ':':
+			if !inBrackets {
+				parts = append(parts, spec[start:i])
+				start = i + 1
+			}
+		}
+	}
+	parts = append(parts, spec[start:])
+	for i, part := range parts {
+		parts[i] = strings.TrimSuffix(strings.TrimPrefix(part, "["), "]")
+	}
+	return parts
+}
+
+func forwardLocalConn(addr, target string, local net.Conn) {
+	conn, err := dialForward(addr, target)
+	if err != nil {
+		log.Printf("Error forwarding %s to %s: %v", local.RemoteAddr(), target, err)
+		local.Close()
+		return
+	}
+	common.Pipe(local, conn)
+}
+
+// dialForward connects to the target through the server.
+func dialForward(addr, target string) (net.Conn, error) {
+	conn, err := connectConnType(addr, common.TcpForward)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{common.HeaderForwardDial}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := common.WriteJsonFrame(conn, common.ForwardReq{Addr: target}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := common.ReadResp(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// runRemoteForward has the server listen on the bind address and forwards the
+// connections it accepts to the target until the connection to the server is
+// lost.
+func runRemoteForward(addr string, fwd forwardSpec) error {
+	conn, err := connectConnType(addr, common.TcpForward)
+	if err != nil {
+		return fmt.Errorf("error connecting: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{common.HeaderForwardListen}); err != nil {
+		return fmt.Errorf("error sending request: %w", err)
+	}
+	if err := common.WriteJsonFrame(conn, common.ForwardReq{Addr: fwd.bind}); err != nil {
+		return fmt.Errorf("error sending request: %w", err)
+	}
+	if err := common.ReadResp(conn); err != nil {
+		return fmt.Errorf("error listening on %s: %w", fwd.bind, err)
+	}
+	bound, err := common.ReadStr16(conn)
+	if err != nil {
+		return fmt.Errorf("error reading response: %w", err)
+	}
+	desc := fmt.Sprintf("Forwarding %s on server to %s", bound, fwd.target)
+	addForwarding(desc)
+	defer removeForwarding(desc)
+
+	var buf [9]byte
+	for {
+		if _, err := io.ReadFull(conn, buf[:]); err != nil {
+			return fmt.Errorf("lost connection forwarding %s: %w", bound, err)
+		} else if buf[0] != common.ActionForwardConn {
+			return fmt.Errorf("received unknown action: %d", buf[0])
+		}
+		go forwardRemoteConn(addr, fwd.target, binary.LittleEndian.Uint64(buf[1:]))
+	}
+}
+
+// forwardRemoteConn connects back to the server for the accepted connection
+// with the given ID and forwards it to the target.
+func forwardRemoteConn(addr, target string, id uint64) {
+	conn, err := connectConnType(addr, common.TcpForward)
+	if err != nil {
+		log.Print("Error connecting: ", err)
+		return
+	}
+	buf := binary.LittleEndian.AppendUint64(
+		[]byte{common.HeaderForwardAccept}, id,
+	)
+	if _, err := conn.Write(buf); err != nil {
+		log.Print("Error sending request: ", err)
+		conn.Close()
+		return
+	}
+	if err := common.ReadResp(conn); err != nil {
+		log.Printf("Error accepting connection %d: %v", id, err)
+		conn.Close()
+		return
+	}
+	// Connect to the target after accepting so the remote connection is closed
+	// right away if it fails
+	local, err := net.DialTimeout("tcp", target, time.Second*10)
+	if err != nil {
+		log.Printf("Error forwarding to %s: %v", target, err)
+		conn.Close()
+		return
+	}
+	common.Pipe(conn, local)
+}
@@ -2,11 +2,20 @@ package client
 
 import (
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/johnietre/gossh/common"
 	utils "github.com/johnietre/utils/go"
@@ -25,26 +34,478 @@ func getProcsCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "procs",
 		Short: "Run procs client",
-		// FIXME: add more
-		Long: "Perform actions with the procs on the gossh server",
+		Long:  "Start, inspect, signal, and wait for the processes managed by the gossh server. Exited processes are kept in a history until purged or pruned by the server.",
+	}
+	cmd.AddCommand(
+		getAddProcCmd(),
+		getListProcsCmd(),
+		getGetProcCmd(),
+		getSignalProcCmd(),
+		getKillProcCmd(),
+		getWaitProcCmd(),
+		getProcLogsCmd(),
+		getPurgeProcsCmd(),
+	)
+	return cmd
+}
+
+func getListProcsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "list <ADDR>",
+		Aliases: []string{"ls", "l"},
+		Short:   "List the processes on the server",
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			addr, flags := args[0], cmd.Flags()
+			req := common.GetProcsReq{
+				Name:   must(flags.GetString("name")),
+				Status: must(flags.GetString("status")),
+				Env:    must(flags.GetBool("env")),
+			}
+			var procs common.Procs
+			if useHttp {
+				password = handlePasswordErr(getPassword(addr))
+				query := url.Values{}
+				if req.Name != "" {
+					query.Set("name", req.Name)
+				}
+				if req.Status != "" {
+					query.Set("status", req.Status)
+				}
+				if req.Env {
+					query.Set("env", "1")
+				}
+				u := path.Join(addr, "procs")
+				if len(query) != 0 {
+					u += "?" + query.Encode()
+				}
+				body, err := doReq(newReq(http.MethodGet, u, nil))
+				if err != nil {
+					log.Fatal("Error listing processes: ", err)
+				}
+				if err := json.Unmarshal(body, &procs); err != nil {
+					log.Fatal("Error parsing response: ", err)
+				}
+			} else {
+				conn := connectProcs(addr, common.HeaderGetProcs)
+				defer conn.Close()
+				if err := common.WriteJsonFrame(conn, req); err != nil {
+					log.Fatal("Error sending request: ", err)
+				}
+				if err := common.ReadResp(conn); err != nil {
+					log.Fatal("Error listing processes: ", err)
+				}
+				if err := common.ReadJsonFrame(conn, &procs); err != nil {
+					log.Fatal("Error reading response: ", err)
+				}
+			}
+			if jsonOutput {
+				printJson(procs)
+				return
+			}
+			printProcs(procs)
+		},
+	}
+	flags := cmd.Flags()
+	flags.BoolVar(&jsonOutput, "json", false, "Output as JSON")
+	flags.String("name", "", "Only list processes with names matching the pattern (e.g., web-*)")
+	flags.String(
+		"status", "",
+		fmt.Sprintf(
+			"Only list processes with the status (%s or %s)",
+			common.ProcRunning, common.ProcExited,
+		),
+	)
+	flags.Bool("env", false, "Include the environment of each process (only shown with --json)")
+	return cmd
+}
+
+func getGetProcCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "get <ADDR> <ID>",
+		Aliases: []string{"g"},
+		Short:   "Get a process on the server",
+		Args:    cobra.ExactArgs(2),
 		Run: func(cmd *cobra.Command, args []string) {
+			addr, id := args[0], parseProcId(args[1])
+			getEnv := must(cmd.Flags().GetBool("env"))
+			proc := &common.Process{}
+			if useHttp {
+				password = handlePasswordErr(getPassword(addr))
+				u := path.Join(addr, "procs", strconv.FormatUint(id, 10))
+				if getEnv {
+					u += "?env=1"
+				}
+				body, err := doReq(newReq(http.MethodGet, u, nil))
+				if err != nil {
+					log.Fatal("Error getting process: ", err)
+				}
+				if err := json.Unmarshal(body, proc); err != nil {
+					log.Fatal("Error parsing response: ", err)
+				}
+			} else {
+				conn := connectProcs(addr, common.HeaderGetProc)
+				defer conn.Close()
+				req := common.GetProcReq{Id: id, Env: getEnv}
+				if err := common.WriteJsonFrame(conn, req); err != nil {
+					log.Fatal("Error sending request: ", err)
+				}
+				if err := common.ReadResp(conn); err != nil {
+					log.Fatal("Error getting process: ", err)
+				}
+				if err := common.ReadJsonFrame(conn, proc); err != nil {
+					log.Fatal("Error reading response: ", err)
+				}
+			}
+			if jsonOutput {
+				printJson(proc)
+				return
+			}
+			printProc(proc)
 		},
 	}
-	cmd.AddCommand(getAddProcCmd())
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Output as JSON")
+	cmd.Flags().Bool("env", false, "Include the environment of the process")
 	return cmd
 }
 
 func getSignalProcCmd() *cobra.Command {
-	// TODO
 	cmd := &cobra.Command{
-		Use:     "signal [ADDR]",
+		Use:     "signal <ADDR> <ID> <SIGNAL>",
 		Aliases: []string{"s"},
 		Short:   "Signal a process on the server",
-		Long:    "", // TODO
+		Long:    "Send a signal to a process on the server. The signal can be a number or a name, with or without the SIG prefix (e.g., TERM or SIGTERM).",
+		Args:    cobra.ExactArgs(3),
+		Run: func(cmd *cobra.Command, args []string) {
+			sig, err := common.ParseSignal(args[2])
+			if err != nil {
+				log.Fatal(err)
+			}
+			runSignalProc(args[0], parseProcId(args[1]), sig)
+		},
+	}
+	return cmd
+}
+
+func getKillProcCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "kill <ADDR> <ID>",
+		Aliases: []string{"k"},
+		Short:   "Kill a process on the server",
+		Long:    "Kill a process on the server with SIGKILL. Use signal to send a different signal.",
+		Args:    cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			runSignalProc(args[0], parseProcId(args[1]), syscall.SIGKILL)
+		},
+	}
+	return cmd
+}
+
+func runSignalProc(addr string, id uint64, sig syscall.Signal) {
+	if useHttp {
+		password = handlePasswordErr(getPassword(addr))
+		u := path.Join(addr, "procs", strconv.FormatUint(id, 10), "signal") +
+			"?signal=" + strconv.Itoa(int(sig))
+		if _, err := doReq(newReq(http.MethodPost, u, nil)); err != nil {
+			log.Fatal("Error signaling process: ", err)
+		}
+		return
+	}
+	conn := connectProcs(addr, common.HeaderSignalProc)
+	defer conn.Close()
+	buf := binary.LittleEndian.AppendUint64(nil, id)
+	if _, err := utils.WriteAll(conn, append(buf, byte(sig))); err != nil {
+		log.Fatal("Error sending request: ", err)
+	}
+	if err := common.ReadResp(conn); err != nil {
+		log.Fatal("Error signaling process: ", err)
+	}
+}
+
+func getWaitProcCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "wait <ADDR> <ID>",
+		Aliases: []string{"w"},
+		Short:   "Wait for a process on the server to exit",
+		Long:    "Block until a process on the server exits, then exit with its exit code (or 128+N if it was killed by signal N).",
+		Args:    cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			addr, id := args[0], parseProcId(args[1])
+			var es common.ExitStatus
+			if useHttp {
+				password = handlePasswordErr(getPassword(addr))
+				u := path.Join(addr, "procs", strconv.FormatUint(id, 10), "wait")
+				body, err := doReq(newReq(http.MethodGet, u, nil))
+				if err != nil {
+					log.Fatal("Error waiting for process: ", err)
+				}
+				if err := json.Unmarshal(body, &es); err != nil {
+					log.Fatal("Error parsing response: ", err)
+				}
+			} else {
+				conn := connectProcs(addr, common.HeaderWaitProc)
+				defer conn.Close()
+				_, err := utils.WriteAll(conn, binary.LittleEndian.AppendUint64(nil, id))
+				if err != nil {
+					log.Fatal("Error sending request: ", err)
+				}
+				if err := common.ReadResp(conn); err != nil {
+					log.Fatal("Error waiting for process: ", err)
+				}
+				if es, err = common.ReadExitStatus(conn); err != nil {
+					log.Fatal("Error reading response: ", err)
+				}
+			}
+			if es.Signal != 0 {
+				log.Printf("Process %s", es)
+			}
+			os.Exit(es.ExitCode())
+		},
+	}
+	return cmd
+}
+
+func getProcLogsCmd() *cobra.Command {
+	var timestamps bool
+	cmd := &cobra.Command{
+		Use:   "logs <ADDR> <ID>",
+		Short: "Print the output of a process on the server",
+		Long:  "Print the captured output of a process on the server, its stdout to stdout and its stderr to stderr.",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			addr, flags := args[0], cmd.Flags()
+			req := common.ProcLogsReq{
+				Id:     parseProcId(args[1]),
+				Follow: must(flags.GetBool("follow")),
+				Tail:   must(flags.GetInt("tail")),
+			}
+			if req.Tail < 0 {
+				log.Fatal("--tail must not be negative")
+			}
+			sinceStr := must(flags.GetString("since"))
+			if sinceStr != "" {
+				since, err := common.ParseSince(sinceStr, time.Now())
+				if err != nil {
+					log.Fatal(err)
+				}
+				req.Since = since
+			}
+			printLine := func(line common.ProcLogLine) {
+				if jsonOutput {
+					json.NewEncoder(os.Stdout).Encode(line)
+					return
+				}
+				w := os.Stdout
+				if line.Stream == "stderr" {
+					w = os.Stderr
+				}
+				if timestamps {
+					fmt.Fprintf(w, "%s %s\n", line.Time.Format(time.RFC3339Nano), line.Text)
+				} else {
+					fmt.Fprintln(w, line.Text)
+				}
+			}
+
+			if useHttp {
+				password = handlePasswordErr(getPassword(addr))
+				query := url.Values{}
+				if req.Follow {
+					query.Set("follow", "1")
+				}
+				if req.Tail != 0 {
+					query.Set("tail", strconv.Itoa(req.Tail))
+				}
+				if !req.Since.IsZero() {
+					query.Set("since", req.Since.Format(time.RFC3339Nano))
+				}
+				u := path.Join(addr, "procs", strconv.FormatUint(req.Id, 10), "logs")
+				if len(query) != 0 {
+					u += "?" + query.Encode()
+				}
+				resp, err := http.DefaultClient.Do(newReq(http.MethodGet, u, nil))
+				if err != nil {
+					log.Fatal("Error sending request: ", err)
+				}
+				defer resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					body, _ := io.ReadAll(resp.Body)
+					log.Fatal(
+						"Error getting logs: ",
+						common.DecodeHttpError(body, resp.StatusCode),
+					)
+				}
+				dec := json.NewDecoder(resp.Body)
+				for {
+					var line common.ProcLogLine
+					if err := dec.Decode(&line); err == io.EOF {
+						return
+					} else if err != nil {
+						log.Fatal("Error reading logs: ", err)
+					}
+					printLine(line)
+				}
+			}
+
+			conn := connectProcs(addr, common.HeaderProcLogs)
+			defer conn.Close()
+			if err := common.WriteJsonFrame(conn, req); err != nil {
+				log.Fatal("Error sending request: ", err)
+			}
+			if err := common.ReadResp(conn); err != nil {
+				log.Fatal("Error getting logs: ", err)
+			}
+			for {
+				var line common.ProcLogLine
+				if err := common.ReadJsonFrame(conn, &line); err == io.EOF {
+					return
+				} else if err != nil {
+					log.Fatal("Error reading logs: ", err)
+				}
+				printLine(line)
+			}
+		},
+	}
+	flags := cmd.Flags()
+	flags.BoolP("follow", "f", false, "Keep printing output until the process exits")
+	flags.Int("tail", 0, "Only print the last N lines (0 prints all)")
+	flags.String(
+		"since", "",
+		`Only print lines output since a time (RFC 3339) or for a duration (e.g., "10m")`,
+	)
+	flags.BoolVarP(&timestamps, "timestamps", "t", false, "Prefix lines with the time they were output")
+	flags.BoolVar(&jsonOutput, "json", false, "Output lines as JSON")
+	return cmd
+}
+
+func getPurgeProcsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "purge <ADDR> [ID]...",
+		Short: "Remove exited processes from the server's history",
+		Long:  "Remove the exited processes with the given IDs, or all exited processes if none are given, from the server's history.",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			addr := args[0]
+			var req common.PurgeProcsReq
+			for _, arg := range args[1:] {
+				req.Ids = append(req.Ids, parseProcId(arg))
+			}
+			var purged []uint64
+			if useHttp {
+				if len(req.Ids) > 1 {
+					log.Fatal("Only one ID can be purged at a time with --http")
+				}
+				password = handlePasswordErr(getPassword(addr))
+				u := path.Join(addr, "procs")
+				if len(req.Ids) == 1 {
+					u = path.Join(u, strconv.FormatUint(req.Ids[0], 10))
+				}
+				body, err := doReq(newReq(http.MethodDelete, u, nil))
+				if err != nil {
+					log.Fatal("Error purging processes: ", err)
+				}
+				if err := json.Unmarshal(body, &purged); err != nil {
+					log.Fatal("Error parsing response: ", err)
+				}
+			} else {
+				conn := connectProcs(addr, common.HeaderPurgeProcs)
+				defer conn.Close()
+				if err := common.WriteJsonFrame(conn, req); err != nil {
+					log.Fatal("Error sending request: ", err)
+				}
+				if err := common.ReadResp(conn); err != nil {
+					log.Fatal("Error purging processes: ", err)
+				}
+				if err := common.ReadJsonFrame(conn, &purged); err != nil {
+					log.Fatal("Error reading response: ", err)
+				}
+			}
+			if jsonOutput {
+				printJson(purged)
+				return
+			}
+			fmt.Printf("Purged %d process(es)\n", len(purged))
+		},
 	}
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Output the purged IDs as JSON")
 	return cmd
 }
 
+// connectProcs connects to the procs server and sends the header.
+func connectProcs(addr string, header byte) net.Conn {
+	conn, err := connectConnType(addr, common.TcpProcs)
+	if err != nil {
+		log.Fatal("Error connecting: ", err)
+	}
+	if _, err := conn.Write([]byte{header}); err != nil {
+		log.Fatal("Error sending request: ", err)
+	}
+	return conn
+}
+
+func parseProcId(s string) uint64 {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid process ID %q", s)
+	}
+	return id
+}
+
+func printProcs(procs common.Procs) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tSTATUS\tSTARTED\tCOMMAND")
+	for _, proc := range procs {
+		fmt.Fprintf(
+			tw, "%d\t%s\t%s\t%s\t%s\n",
+			proc.Id, proc.Name, procStatus(proc),
+			formatUnix(proc.Start), procCommand(proc),
+		)
+	}
+	tw.Flush()
+}
+
+func printProc(proc *common.Process) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID:\t%d\n", proc.Id)
+	fmt.Fprintf(tw, "Name:\t%s\n", proc.Name)
+	fmt.Fprintf(tw, "Command:\t%s\n", procCommand(proc))
+	fmt.Fprintf(tw, "Dir:\t%s\n", proc.Dir)
+	fmt.Fprintf(tw, "Status:\t%s\n", procStatus(proc))
+	fmt.Fprintf(tw, "Started:\t%s\n", formatUnix(proc.Start))
+	if proc.End != 0 {
+		runtime := time.Duration(proc.Runtime * float64(time.Second))
+		fmt.Fprintf(tw, "Ended:\t%s\n", formatUnix(proc.End))
+		fmt.Fprintf(tw, "Runtime:\t%s\n", runtime.Round(time.Millisecond))
+	}
+	fmt.Fprintf(tw, "Stdin:\t%s\n", proc.Stdin)
+	fmt.Fprintf(tw, "Stdout:\t%s\n", proc.Stdout)
+	fmt.Fprintf(tw, "Stderr:\t%s\n", proc.Stderr)
+	for _, kv := range proc.Env {
+		fmt.Fprintf(tw, "Env:\t%s\n", kv)
+	}
+	tw.Flush()
+	if len(proc.Output) != 0 {
+		fmt.Println("Output:")
+		for _, line := range proc.Output {
+			fmt.Printf("  %s\n", line.Text)
+		}
+	}
+}
+
+// procStatus returns the status of the process, with the exit status if it
+// has exited.
+func procStatus(proc *common.Process) string {
+	if proc.Exit != nil {
+		return proc.Exit.String()
+	} else if proc.End != 0 {
+		return common.ProcExited
+	}
+	return common.ProcRunning
+}
+
+func procCommand(proc *common.Process) string {
+	return strings.Join(append([]string{proc.Program}, proc.Args...), " ")
+}
+
 func getAddProcCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:     "add [ADDR] [OPTIONS] -- <CMD>",
@@ -88,6 +549,9 @@ func getAddProcCmd() *cobra.Command {
 				proc.Env = append(os.Environ(), proc.Env...)
 			}
 			pipe := must(flags.GetBool("pipe"))
+			if !pipe && (logPath != "" || logInput != "") {
+				log.Fatal("--log and --log-input require --pipe")
+			}
 			if pipe {
 				proc.Stdout, proc.Stderr = common.ProcPipe, common.ProcPipe
 				proc.Stdin = common.ProcPipe
@@ -101,26 +565,25 @@ func getAddProcCmd() *cobra.Command {
 				if err != nil {
 					log.Fatal("Error serializing process: ", err)
 				}
-				password = handlePasswordErr(getPassword())
+				password = handlePasswordErr(getPassword(addr))
 				req := newReq(http.MethodPost, path.Join(addr, "procs"), body)
 				resp, err := http.DefaultClient.Do(req)
 				if err != nil {
 					log.Fatal("Error sending request: ", err)
 				}
 				defer resp.Body.Close()
-				if resp.StatusCode == http.StatusOK {
-					log.Print("SUCCESS")
-				} else {
-					log.Print("Received non-200 status: ", resp.StatusCode)
-				}
 				bytes, err := io.ReadAll(resp.Body)
 				if err != nil {
 					log.Fatal("Error reading response body: ", err)
 				}
-				os.Stdout.Write(bytes)
 				if resp.StatusCode != http.StatusOK {
-					os.Exit(1)
+					log.Fatal(
+						"Error adding process: ",
+						common.DecodeHttpError(bytes, resp.StatusCode),
+					)
 				}
+				log.Print("SUCCESS")
+				os.Stdout.Write(bytes)
 				return
 			}
 			// Connect
@@ -130,7 +593,7 @@ func getAddProcCmd() *cobra.Command {
 				log.Fatal("Error connecting: ", err)
 			}
 			// Send password
-			password = handlePasswordErr(getPassword())
+			password = handlePasswordErr(getPassword(addr))
 			gotPassword = true
 			if err := sendPassword(conn, nil); err != nil {
 				log.Fatal("Error connecting: ", err)
@@ -162,18 +625,19 @@ func getAddProcCmd() *cobra.Command {
 				return
 			}
 			// Get response
-			b := make([]byte, 1)
-			if _, err := conn.Read(b); err != nil {
+			if err := common.ReadResp(conn); err != nil {
+				log.Fatal("Error adding process: ", err)
+			}
+			b := make([]byte, 8)
+			if _, err := io.ReadFull(conn, b); err != nil {
 				log.Fatal("Error reading response: ", err)
 			}
-			if b[0] != common.RespOk {
-				log.Print("Received non-Ok response: ", b[0])
-				errMsg, err := readErrResp(conn)
-				if err != nil {
-					log.Fatal("Error reading error response: ", err)
-				}
-				log.Fatal(string(errMsg))
+			b = make([]byte, binary.LittleEndian.Uint64(b))
+			if _, err := io.ReadFull(conn, b); err != nil {
+				log.Fatal("Error reading response: ", err)
 			}
+			log.Print("SUCCESS")
+			os.Stdout.Write(append(b, '\n'))
 		},
 	}
 	flags := cmd.Flags()
@@ -200,5 +664,21 @@ func getAddProcCmd() *cobra.Command {
 	)
 	flags.StringVar(&envFile, "envfile", "", "Path to .env file")
 	flags.Bool("pipe", false, "Pipe stdin/stdout/stderr to this machine")
+	flags.StringVar(
+		&proc.Stdout, "stdout", "",
+		`Where stdout goes on the server: "null" (the default), "log" (a log file managed by the server), or a file path relative to --dir (prefix with ">>" to append)`,
+	)
+	flags.StringVar(
+		&proc.Stderr, "stderr", "",
+		`Where stderr goes on the server: the same as --stdout, or "stdout" to send it wherever stdout goes`,
+	)
+	flags.StringVar(
+		&proc.Stdin, "stdin", "",
+		`Where stdin comes from on the server: "null" (the default) or a file path relative to --dir`,
+	)
+	addLogFlags(flags)
+	cmd.MarkFlagsMutuallyExclusive("pipe", "stdout")
+	cmd.MarkFlagsMutuallyExclusive("pipe", "stderr")
+	cmd.MarkFlagsMutuallyExclusive("pipe", "stdin")
 	return cmd
 }
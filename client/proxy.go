@@ -0,0 +1,242 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/johnietre/gossh/common"
+	"github.com/spf13/cobra"
+)
+
+func getProxyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "proxy <ADDR>",
+		Short: "Run a local SOCKS5/HTTP proxy through the gossh server",
+		Long:  "Run a local proxy whose outbound connections are made from the gossh server. Each port accepts both SOCKS5 (without authentication) and HTTP CONNECT requests. The server must allow forwarding to each destination (see the server's --allow-forward and --deny-forward flags).",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			fwds := getForwardFlags(cmd.Flags())
+			if len(fwds.dynamic) == 0 {
+				log.Fatal("No proxy ports specified")
+			}
+			password = handlePasswordErr(getPassword(args[0]))
+			gotPassword = true
+			log.Fatal(<-startForwards(args[0], fwds))
+		},
+	}
+	addDynamicForwardFlag(cmd.Flags())
+	return cmd
+}
+
+// parseProxySpec parses a spec in the format [BIND_ADDR:]PORT.
+func parseProxySpec(spec string) (string, error) {
+	parts := splitForwardSpec(spec)
+	switch len(parts) {
+	case 1:
+		return net.JoinHostPort("localhost", parts[0]), nil
+	case 2:
+		if parts[0] == "*" {
+			parts[0] = ""
+		}
+		return net.JoinHostPort(parts[0], parts[1]), nil
+	}
+	return "", fmt.Errorf("invalid proxy port %q", spec)
+}
+
+// handleProxyConn handles a SOCKS5 or HTTP CONNECT request, depending on the
+// first byte sent.
+func handleProxyConn(addr string, c net.Conn) {
+	bc := &bufConn{Conn: c, r: bufio.NewReader(c)}
+	first, err := bc.r.Peek(1)
+	if err != nil {
+		c.Close()
+		return
+	}
+	var target string
+	var conn net.Conn
+	if first[0] == 5 {
+		target, conn, err = handleSocks5(addr, bc)
+	} else {
+		target, conn, err = handleHttpConnect(addr, bc)
+	}
+	if err != nil {
+		if target != "" {
+			log.Printf("Error proxying %s to %s: %v", c.RemoteAddr(), target, err)
+		} else {
+			log.Printf("Error proxying %s: %v", c.RemoteAddr(), err)
+		}
+		c.Close()
+		return
+	}
+	common.Pipe(bc, conn)
+}
+
+// SOCKS5 replies
+const (
+	socksSucceeded          byte = 0
+	socksGeneralFailure     byte = 1
+	socksNotAllowed         byte = 2
+	socksHostUnreachable    byte = 4
+	socksTtlExpired         byte = 6
+	socksCmdNotSupported    byte = 7
+	socksAddrNotSupported   byte = 8
+	socksNoAcceptableMethod byte = 0xFF
+)
+
+// handleSocks5 handles a SOCKS5 CONNECT request (see RFC 1928), returning the
+// connection to the target.
+func handleSocks5(addr string, c *bufConn) (string, net.Conn, error) {
+	var buf [255]byte
+	// Version and methods
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return "", nil, err
+	}
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return "", nil, err
+	}
+	noAuth := false
+	for _, m := range methods {
+		noAuth = noAuth || m == 0
+	}
+	if !noAuth {
+		c.Write([]byte{5, socksNoAcceptableMethod})
+		return "", nil, errors.New("client doesn't support no authentication")
+	}
+	if _, err := c.Write([]byte{5, 0}); err != nil {
+		return "", nil, err
+	}
+
+	// Request
+	if _, err := io.ReadFull(c, buf[:4]); err != nil {
+		return "", nil, err
+	}
+	cmd, atyp := buf[1], buf[3]
+	var host string
+	switch atyp {
+	case 1:
+		if _, err := io.ReadFull(c, buf[:4]); err != nil {
+			return "", nil, err
+		}
+		host = net.IP(buf[:4]).String()
+	case 3:
+		if _, err := io.ReadFull(c, buf[:1]); err != nil {
+			return "", nil, err
+		}
+		l := buf[0]
+		if _, err := io.ReadFull(c, buf[:l]); err != nil {
+			return "", nil, err
+		}
+		host = string(buf[:l])
+	case 4:
+		if _, err := io.ReadFull(c, buf[:16]); err != nil {
+			return "", nil, err
+		}
+		host = net.IP(buf[:16]).String()
+	default:
+		writeSocksReply(c, socksAddrNotSupported)
+		return "", nil, fmt.Errorf("unsupported address type: %d", atyp)
+	}
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return "", nil, err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	target := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	if cmd != 1 {
+		writeSocksReply(c, socksCmdNotSupported)
+		return target, nil, fmt.Errorf("unsupported command: %d", cmd)
+	}
+
+	conn, err := dialForward(addr, target)
+	if err != nil {
+		rep := socksGeneralFailure
+		if errors.Is(err, common.ErrPermission) {
+			rep = socksNotAllowed
+		} else if errors.Is(err, common.ErrTimeout) {
+			rep = socksTtlExpired
+		} else {
+			var e *common.Error
+			if errors.As(err, &e) {
+				rep = socksHostUnreachable
+			}
+		}
+		writeSocksReply(c, rep)
+		return target, nil, err
+	}
+	if err := writeSocksReply(c, socksSucceeded); err != nil {
+		conn.Close()
+		return target, nil, err
+	}
+	return target, conn, nil
+}
+
+// writeSocksReply writes a reply. The bound address is always reported as
+// 0.0.0.0:0 since it's on the server.
+func writeSocksReply(c net.Conn, rep byte) error {
+	_, err := c.Write([]byte{5, rep, 0, 1, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// handleHttpConnect handles an HTTP CONNECT request, returning the connection
+// to the target.
+func handleHttpConnect(addr string, c *bufConn) (string, net.Conn, error) {
+	req, err := http.ReadRequest(c.r)
+	if err != nil {
+		return "", nil, err
+	}
+	if req.Method != http.MethodConnect {
+		writeHttpStatus(c, http.StatusMethodNotAllowed)
+		return "", nil, fmt.Errorf("unsupported method: %s", req.Method)
+	}
+	target := req.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "443")
+	}
+	conn, err := dialForward(addr, target)
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, common.ErrPermission) {
+			status = http.StatusForbidden
+		} else if errors.Is(err, common.ErrTimeout) {
+			status = http.StatusGatewayTimeout
+		}
+		writeHttpStatus(c, status)
+		return target, nil, err
+	}
+	if err := writeHttpStatus(c, http.StatusOK); err != nil {
+		conn.Close()
+		return target, nil, err
+	}
+	return target, conn, nil
+}
+
+func writeHttpStatus(c net.Conn, status int) error {
+	_, err := fmt.Fprintf(
+		c, "HTTP/1.1 %d %s\r\n\r\n", status, http.StatusText(status),
+	)
+	return err
+}
+
+// bufConn is a connection whose reads go through a bufio.Reader.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (bc *bufConn) Read(p []byte) (int, error) {
+	return bc.r.Read(p)
+}
+
+func (bc *bufConn) CloseWrite() error {
+	if cw, ok := bc.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return bc.Conn.Close()
+}
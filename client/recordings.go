@@ -0,0 +1,191 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"text/tabwriter"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/johnietre/gossh/common"
+	"github.com/spf13/cobra"
+)
+
+func getRecordingsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "recordings",
+		Aliases: []string{"recs"},
+		Short:   "List and download SSH session recordings",
+		Long:    "List and download SSH session recordings from the gossh server. Recordings are always fetched over HTTP. Non-admin users can only access recordings of their own sessions.",
+	}
+	cmd.AddCommand(getListRecordingsCmd(), getGetRecordingCmd())
+	return cmd
+}
+
+func getListRecordingsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "list <ADDR>",
+		Aliases: []string{"ls", "l"},
+		Short:   "List session recordings",
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			password = handlePasswordErr(getPassword(args[0]))
+			req := newReq(http.MethodGet, path.Join(args[0], "recordings"), nil)
+			body, err := doReq(req)
+			if err != nil {
+				log.Fatal("Error listing recordings: ", err)
+			}
+			var recs []common.RecordingInfo
+			if err := json.Unmarshal(body, &recs); err != nil {
+				log.Fatal("Error parsing response: ", err)
+			}
+			if jsonOutput {
+				printJson(recs)
+				return
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "NAME\tSESSION\tUSER\tSTARTED\tSIZE")
+			for _, rec := range recs {
+				fmt.Fprintf(
+					tw, "%s\t%d\t%s\t%s\t%d\n",
+					rec.Name, rec.Session, rec.User, formatUnix(rec.Start), rec.Size,
+				)
+			}
+			tw.Flush()
+		},
+	}
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Output as JSON")
+	return cmd
+}
+
+func getGetRecordingCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "get <ADDR> <NAME>",
+		Aliases: []string{"g"},
+		Short:   "Download a session recording",
+		Args:    cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			out := must(cmd.Flags().GetString("output"))
+			if out == "" {
+				out = args[1]
+			}
+			password = handlePasswordErr(getPassword(args[0]))
+			req := newReq(
+				http.MethodGet,
+				path.Join(args[0], "recordings", url.PathEscape(args[1])),
+				nil,
+			)
+			body, err := doReq(req)
+			if err != nil {
+				log.Fatal("Error getting recording: ", err)
+			}
+			if out == "-" {
+				os.Stdout.Write(body)
+				return
+			}
+			if err := os.WriteFile(out, body, 0600); err != nil {
+				log.Fatal("Error writing recording: ", err)
+			}
+		},
+	}
+	cmd.Flags().StringP(
+		"output", "o", "",
+		`File to write the recording to ("-" for stdout, defaults to the recording name)`,
+	)
+	return cmd
+}
+
+func getReplayCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "replay <FILE>",
+		Short: "Replay an SSH session recording",
+		Long:  `Replay an asciicast v2 recording (e.g., one downloaded using "recordings get") in the terminal. Pass "-" to read from stdin.`,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			flags := cmd.Flags()
+			speed := must(flags.GetFloat64("speed"))
+			if speed <= 0 {
+				log.Fatal("Speed must be positive")
+			}
+			idleLimit := must(flags.GetDuration("idle-limit"))
+			var r io.Reader = os.Stdin
+			if args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					log.Fatal("Error opening recording: ", err)
+				}
+				defer f.Close()
+				r = f
+			}
+			if err := runReplay(r, speed, idleLimit); err != nil {
+				log.Fatal("\nError replaying: ", err)
+			}
+		},
+	}
+	flags := cmd.Flags()
+	flags.Float64P("speed", "s", 1, "Playback speed multiplier")
+	flags.Duration(
+		"idle-limit", 0,
+		"Max time to wait between output, before being sped up (0 means no limit)",
+	)
+	return cmd
+}
+
+func runReplay(r io.Reader, speed float64, idleLimit time.Duration) error {
+	br := bufio.NewReader(r)
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("error reading header: %w", err)
+	}
+	var header common.CastHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return fmt.Errorf("error parsing header: %w", err)
+	} else if header.Version != 2 {
+		return fmt.Errorf("unsupported asciicast version: %d", header.Version)
+	}
+	if ws, err := pty.GetsizeFull(os.Stdout); err == nil {
+		if ws.Cols < header.Width || ws.Rows < header.Height {
+			log.Printf(
+				"Warning: terminal (%dx%d) is smaller than recording (%dx%d)",
+				ws.Cols, ws.Rows, header.Width, header.Height,
+			)
+		}
+	}
+
+	prev := 0.0
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var event [3]any
+		if err := json.Unmarshal(line, &event); err != nil {
+			return fmt.Errorf("error parsing event: %w", err)
+		}
+		t, ok1 := event[0].(float64)
+		code, ok2 := event[1].(string)
+		data, ok3 := event[2].(string)
+		if !ok1 || !ok2 || !ok3 {
+			return fmt.Errorf("invalid event: %s", line)
+		}
+		delay := time.Duration((t - prev) * float64(time.Second))
+		if idleLimit > 0 && delay > idleLimit {
+			delay = idleLimit
+		}
+		prev = t
+		time.Sleep(time.Duration(float64(delay) / speed))
+		if code == "o" {
+			os.Stdout.WriteString(data)
+		}
+	}
+}
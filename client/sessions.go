@@ -0,0 +1,222 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"text/tabwriter"
+	"time"
+
+	"github.com/johnietre/gossh/common"
+	"github.com/spf13/cobra"
+)
+
+var (
+	jsonOutput bool
+)
+
+func getSessionsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sessions",
+		Short: "Manage SSH sessions",
+		Long:  "List and terminate the SSH sessions running on the gossh server. Non-admin users can only see and manage their own sessions.",
+	}
+	cmd.AddCommand(
+		getListSessionsCmd(),
+		getKillSessionCmd(),
+		getShareSessionCmd(),
+		getUnshareSessionCmd(),
+	)
+	return cmd
+}
+
+func getListSessionsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "list <ADDR>",
+		Aliases: []string{"ls", "l"},
+		Short:   "List active SSH sessions",
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			addr := args[0]
+			var infos []common.SessionInfo
+			if useHttp {
+				password = handlePasswordErr(getPassword(addr))
+				req := newReq(http.MethodGet, path.Join(addr, "sessions"), nil)
+				body, err := doReq(req)
+				if err != nil {
+					log.Fatal("Error listing sessions: ", err)
+				}
+				if err := json.Unmarshal(body, &infos); err != nil {
+					log.Fatal("Error parsing response: ", err)
+				}
+			} else {
+				conn, err := connectConn(addr)
+				if err != nil {
+					log.Fatal("Error connecting: ", err)
+				}
+				defer conn.Close()
+				if _, err := conn.Write([]byte{common.HeaderListSsh}); err != nil {
+					log.Fatal("Error sending request: ", err)
+				}
+				if err := common.ReadResp(conn); err != nil {
+					log.Fatal("Error listing sessions: ", err)
+				}
+				if err := common.ReadJsonFrame(conn, &infos); err != nil {
+					log.Fatal("Error reading response: ", err)
+				}
+			}
+			if jsonOutput {
+				printJson(infos)
+				return
+			}
+			printSessions(infos)
+		},
+	}
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Output as JSON")
+	return cmd
+}
+
+func getKillSessionCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "kill <ADDR> <ID|NAME>",
+		Aliases: []string{"k"},
+		Short:   "Terminate an SSH session",
+		Long:    "Terminate an SSH session. The attached client, if any, is notified with the reason.",
+		Args:    cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			addr := args[0]
+			req := common.KillSessionReq{
+				Session: args[1],
+				Reason:  must(cmd.Flags().GetString("reason")),
+			}
+			if useHttp {
+				password = handlePasswordErr(getPassword(addr))
+				u := path.Join(addr, "sessions", url.PathEscape(req.Session))
+				if req.Reason != "" {
+					u += "?reason=" + url.QueryEscape(req.Reason)
+				}
+				if _, err := doReq(newReq(http.MethodDelete, u, nil)); err != nil {
+					log.Fatal("Error killing session: ", err)
+				}
+				return
+			}
+			conn, err := connectConn(addr)
+			if err != nil {
+				log.Fatal("Error connecting: ", err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write([]byte{common.HeaderKillSsh}); err != nil {
+				log.Fatal("Error sending request: ", err)
+			}
+			if err := common.WriteJsonFrame(conn, req); err != nil {
+				log.Fatal("Error sending request: ", err)
+			}
+			if err := common.ReadResp(conn); err != nil {
+				log.Fatal("Error killing session: ", err)
+			}
+		},
+	}
+	cmd.Flags().String("reason", "", "Reason sent to the session's client")
+	return cmd
+}
+
+func getShareSessionCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "share <ADDR> <ID|NAME> <USER>",
+		Short: "Share an SSH session with a user",
+		Long:  "Allow a user to attach to an SSH session. The user can only watch unless --write is passed. Sharing with a user that's already been shared with updates their access.",
+		Args:  cobra.ExactArgs(3),
+		Run: func(cmd *cobra.Command, args []string) {
+			runShareSession(args[0], common.ShareSessionReq{
+				Session: args[1],
+				User:    args[2],
+				Write:   must(cmd.Flags().GetBool("write")),
+			})
+		},
+	}
+	cmd.Flags().Bool("write", false, "Allow the user to type")
+	return cmd
+}
+
+func getUnshareSessionCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "unshare <ADDR> <ID|NAME> <USER>",
+		Short: "Stop sharing an SSH session with a user",
+		Long:  "Stop sharing an SSH session with a user, detaching any of their attached clients.",
+		Args:  cobra.ExactArgs(3),
+		Run: func(cmd *cobra.Command, args []string) {
+			runShareSession(args[0], common.ShareSessionReq{
+				Session: args[1],
+				User:    args[2],
+				Remove:  true,
+			})
+		},
+	}
+}
+
+func runShareSession(addr string, req common.ShareSessionReq) {
+	if useHttp {
+		password = handlePasswordErr(getPassword(addr))
+		u := path.Join(
+			addr, "sessions", url.PathEscape(req.Session),
+			"shares", url.PathEscape(req.User),
+		)
+		method := http.MethodPut
+		if req.Remove {
+			method = http.MethodDelete
+		} else if req.Write {
+			u += "?write=1"
+		}
+		if _, err := doReq(newReq(method, u, nil)); err != nil {
+			log.Fatal("Error sharing session: ", err)
+		}
+		return
+	}
+	conn, err := connectConn(addr)
+	if err != nil {
+		log.Fatal("Error connecting: ", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{common.HeaderShareSsh}); err != nil {
+		log.Fatal("Error sending request: ", err)
+	}
+	if err := common.WriteJsonFrame(conn, req); err != nil {
+		log.Fatal("Error sending request: ", err)
+	}
+	if err := common.ReadResp(conn); err != nil {
+		log.Fatal("Error sharing session: ", err)
+	}
+}
+
+func printSessions(infos []common.SessionInfo) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tUSER\tPEER\tSTARTED\tCOMMAND\tSIZE\tIN\tOUT\tCLIENTS")
+	for _, info := range infos {
+		fmt.Fprintf(
+			tw, "%d\t%s\t%s\t%s\t%s\t%s\t%dx%d\t%d\t%d\t%d\n",
+			info.Id, info.Name, info.User, info.Peer, formatUnix(info.Start),
+			info.Command, info.Cols, info.Rows, info.BytesIn, info.BytesOut,
+			len(info.Clients),
+		)
+	}
+	tw.Flush()
+}
+
+func printJson(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Fatal("Error encoding output: ", err)
+	}
+}
+
+func formatUnix(t int64) string {
+	if t == 0 {
+		return ""
+	}
+	return time.Unix(t, 0).Format("2006-01-02 15:04:05")
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -8,12 +9,16 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/creack/pty"
 	"github.com/johnietre/gossh/common"
 	utils "github.com/johnietre/utils/go"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"golang.org/x/term"
 )
 
@@ -22,17 +27,35 @@ var (
 
 	gotPassword bool = false
 	termState   *term.State
+	// Receives signals when the terminal size should be sent
+	winchCh = make(chan os.Signal, 1)
+
+	sshReq common.SshReq
+	// How long to try reconnecting after the connection is lost
+	reconnectTimeout time.Duration
 )
 
 func getSshCmd() *cobra.Command {
 	addr := os.Getenv(common.AddrEnvName)
 	cmd := &cobra.Command{
-		Use:   fmt.Sprintf("ssh [ADDR (default: %s)]", addr),
+		Use:   fmt.Sprintf("ssh [ADDR (default: %s)] [-- CMD [ARGS...]]", addr),
 		Short: "Run SSH client",
-		Long:  "Connect to a gossh instance acting as an SSH server. The address can either be passed as a CLI arg or is gotten from the value of the " + common.AddrEnvName + " environment variable.",
-		Args:  cobra.MaximumNArgs(1),
+		Long:  "Connect to a gossh instance acting as an SSH server. The address can either be passed as a CLI arg or is gotten from the value of the " + common.AddrEnvName + " environment variable. If a command is given, it is run in the new session instead of the shell. When stdin is a terminal, type the escape character followed by ? at the start of a line to see the supported escape sequences.",
 		Run: func(cmd *cobra.Command, args []string) {
 			addr = cmd.Flags().Arg(0)
+			if dash := cmd.ArgsLenAtDash(); dash > 1 {
+				log.Fatal("Too many arguments before --")
+			} else if dash != -1 {
+				sshReq.Command = args[dash:]
+			} else if len(args) > 1 {
+				log.Fatal("Command must be passed after --")
+			}
+			flags := cmd.Flags()
+			if sshReq.Attach != "" &&
+				(len(sshReq.Command) != 0 || flags.Changed("env") || flags.Changed("dir")) {
+				log.Fatal("Cannot pass a command, env, or dir when attaching")
+			}
+			sshReq.Env = getReqEnv(flags, true)
 			if addr == "" {
 				cmd.ErrOrStderr().Write([]byte("Missing address to connect to"))
 				if err := cmd.Usage(); err != nil {
@@ -40,64 +63,444 @@ func getSshCmd() *cobra.Command {
 				}
 				return
 			}
+			shares := must(cmd.Flags().GetStringArray("share"))
+			if len(shares) != 0 {
+				sshReq.Shares = make(map[string]bool, len(shares))
+			}
+			for _, share := range shares {
+				name, mode, _ := strings.Cut(share, ":")
+				if mode != "" && mode != "ro" && mode != "rw" {
+					log.Fatalf("Invalid share %q: mode must be ro or rw", share)
+				}
+				sshReq.Shares[name] = mode == "rw"
+			}
+			escStr := must(flags.GetString("escape-char"))
+			var err error
+			if escapeChar, err = parseEscapeChar(escStr); err != nil {
+				log.Fatal(err)
+			}
+			if fwds := getForwardFlags(flags); !fwds.empty() {
+				password = handlePasswordErr(getPassword(addr))
+				gotPassword = true
+				errCh := startForwards(addr, fwds)
+				go func() {
+					for err := range errCh {
+						log.Print("\r\nForwarding stopped: ", err, "\r")
+					}
+				}()
+			}
 			if useHttp {
 				addr = path.Join(addr, "ws/ssh")
 			}
 			runSsh(addr, nil, nil)
 		},
 	}
-	//flags := cmd.Flags()
+	flags := cmd.Flags()
 	//flags.BoolVar(&useWs, "ws", false, "Use WebSocket instead of plain TCP")
+	flags.StringVar(
+		&sshReq.Name, "name", "",
+		"Name of the session (named sessions are persistent)",
+	)
+	flags.BoolVarP(
+		&sshReq.Persist, "persist", "p", false,
+		"Keep the session running on the server after disconnecting",
+	)
+	flags.StringVarP(
+		&sshReq.Attach, "attach", "a", "",
+		"ID or name of an existing session to attach to",
+	)
+	flags.BoolVarP(
+		&sshReq.ReadOnly, "read-only", "r", false,
+		"Attach to the session without being able to type",
+	)
+	flags.BoolVarP(
+		&sshReq.DetachOthers, "detach-others", "d", false,
+		"Detach all other clients when attaching",
+	)
+	flags.StringArray(
+		"share", nil,
+		"Share the new session with a user, in the format USER[:ro|rw] (read-only by default)",
+	)
+	addEnvFlags(flags, &sshReq.Dir)
+	flags.DurationVar(
+		&reconnectTimeout, "reconnect-timeout", time.Minute,
+		"How long to try reconnecting and resuming the session after the connection is lost (0 disables reconnecting)",
+	)
+	flags.String(
+		"escape-char", "~",
+		`Escape character for escape sequences typed at the start of a line (a character, ^X for a control character, or "none" to disable)`,
+	)
+	addLogFlags(flags)
+	addLocalForwardFlag(flags)
+	addRemoteForwardFlag(flags)
+	addDynamicForwardFlag(flags)
+	cmd.MarkFlagsMutuallyExclusive("attach", "name")
+	cmd.MarkFlagsMutuallyExclusive("attach", "persist")
+	cmd.MarkFlagsMutuallyExclusive("attach", "share")
 	return cmd
 }
 
-func runSsh(addr string, mainConn, otherConn net.Conn) {
-	conn, other := connectSsh(addr, mainConn, otherConn)
+// addEnvFlags adds the flags used to set the environment and directory of the
+// remote command.
+func addEnvFlags(flags *pflag.FlagSet, dir *string) {
+	flags.StringArrayP(
+		"env", "e", nil,
+		"Environment variable to set, in the format NAME=VALUE or NAME to send the local value (the server must accept it)",
+	)
+	flags.StringVar(
+		dir, "dir", "",
+		"Directory to start in (relative to the server's SSH directory)",
+	)
+}
 
-	ws, err := pty.GetsizeFull(os.Stdin)
-	if err != nil {
-		log.Fatal("Error getting terminal size: ", err)
+// getReqEnv gets the environment variables to send. If sendDefault is true,
+// the local TERM, COLORTERM, and locale variables are sent as well.
+func getReqEnv(flags *pflag.FlagSet, sendDefault bool) map[string]string {
+	env := make(map[string]string)
+	if sendDefault {
+		for _, kv := range os.Environ() {
+			k, v, _ := strings.Cut(kv, "=")
+			if k == "TERM" || k == "COLORTERM" || k == "LANG" ||
+				strings.HasPrefix(k, "LC_") {
+				env[k] = v
+			}
+		}
+	}
+	for _, kv := range must(flags.GetStringArray("env")) {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			if v, ok = os.LookupEnv(k); !ok {
+				continue
+			}
+		}
+		env[k] = v
 	}
-	if _, err := other.Write(common.WinsizeToBytes(nil, ws)); err != nil {
-		log.Fatal("Error sending terminal size: ", err)
+	if len(env) == 0 {
+		return nil
 	}
-	winchCh := make(chan os.Signal, 1)
-	signal.Notify(winchCh, syscall.SIGWINCH)
-	go sshWatchWinSize(other, winchCh)
+	return env
+}
 
-	log.Print("\n===Connected===")
+func runSsh(addr string, mainConn, otherConn net.Conn) {
+	isTerm := term.IsTerminal(int(os.Stdin.Fd()))
+	tr := openTranscript()
+	sshReq.EchoEvents = logInput == "redacted"
+	ws := termSize(isTerm)
+	conn, other, resp, err := openSsh(addr, mainConn, otherConn, sshReq, ws)
+	if err != nil {
+		log.Fatal("Error starting session: ", err)
+	}
+	tr.start(resp.Session, ws)
+	sc := &sshConn{
+		conn:      conn,
+		other:     other,
+		token:     resp.Token,
+		outOffset: resp.Offset,
+		input:     newInputBuf(1 << 16),
+		log:       tr,
+	}
+	log.Printf("\n===Connected (session %d)===", resp.Session)
 	log.Print()
 
-	termState, err = term.MakeRaw(int(os.Stdin.Fd()))
+	if !isTerm {
+		// Without a terminal, Ctrl-C and the like come as signals, which should
+		// reach the remote process as they would a local one
+		forwardSignals(sc.sendSignal)
+	}
+	if isTerm {
+		signal.Notify(winchCh, syscall.SIGWINCH)
+		go sshWatchWinSize(sc)
+
+		var err error
+		termState, err = term.MakeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			log.Fatal("\nError setting terminal: ", err)
+		}
+	}
+
+	go sshStdinToConn(sc, newSshEscaper(sc))
+	for {
+		ctrl := newSshCtrl(sc.log)
+		go ctrl.run(other)
+		err := sc.connToStdout(conn)
+		// Give any final control messages a chance to arrive
+		ctrlDone := ctrl.wait(time.Second)
+		if ctrlDone && ctrl.closed {
+			restoreTerm()
+			log.Printf("\n===Session closed: %s===", ctrl.closeReason)
+			os.Exit(1)
+		} else if ctrlDone && ctrl.exit != nil {
+			ret := ctrl.exit.ExitCode()
+			restoreTerm()
+			if ctrl.exit.Signal != 0 {
+				log.Printf("\nRemote process %s", ctrl.exit)
+			}
+			log.Print("\n===Disconnected===")
+			os.Exit(ret)
+		}
+		conn.Close()
+		other.Close()
+
+		// The connection was lost
+		if sc.token == "" || reconnectTimeout <= 0 {
+			restoreTerm()
+			ret := 0
+			if err != nil {
+				log.Print("\nError reading: ", err)
+				ret = 1
+			}
+			log.Print("\n===Disconnected===")
+			os.Exit(ret)
+		}
+		if conn, other, err = sc.reconnect(addr, isTerm); err != nil {
+			restoreTerm()
+			log.Print("\nError reconnecting: ", err)
+			log.Print("\n===Disconnected===")
+			os.Exit(1)
+		}
+	}
+}
+
+// forwardedSignals are sent to the remote process instead of being handled
+// locally when forwarding signals.
+var forwardedSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
+
+// forwardSignals calls send for each forwarded signal received.
+func forwardSignals(send func(syscall.Signal)) {
+	ch := make(chan os.Signal, 4)
+	signal.Notify(ch, forwardedSignals...)
+	go func() {
+		for sig := range ch {
+			send(sig.(syscall.Signal))
+		}
+	}()
+}
+
+// termSize returns the size of the terminal, or 80x24 if stdin isn't a
+// terminal.
+func termSize(isTerm bool) *pty.Winsize {
+	if !isTerm {
+		return &pty.Winsize{Rows: 24, Cols: 80}
+	}
+	ws, err := pty.GetsizeFull(os.Stdin)
 	if err != nil {
-		log.Fatal("\nError setting terminal: ", err)
+		log.Fatal("Error getting terminal size: ", err)
 	}
+	return ws
+}
 
-	go sshStdinToConn(conn)
-	ret := sshConnToStdout(conn)
-	log.Print("\n===Disconnected===")
-	os.Exit(ret)
+// sshConn holds the current connections to the session, which are replaced
+// when resuming after the connection is lost.
+type sshConn struct {
+	mtx         sync.Mutex
+	conn, other net.Conn
+	// Input sent, kept for resending after resuming
+	input *inputBuf
+
+	// The resume token, empty if resuming isn't supported
+	token string
+	// The number of bytes of session output received. Only accessed while
+	// reading output or resuming.
+	outOffset uint64
+
+	log *transcript
+}
+
+func (sc *sshConn) getConns() (net.Conn, net.Conn) {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	return sc.conn, sc.other
+}
+
+// write sends the input. Write errors are returned but the input is still
+// sent after resuming.
+func (sc *sshConn) write(p []byte) error {
+	sc.mtx.Lock()
+	sc.input.Write(p)
+	conn := sc.conn
+	sc.mtx.Unlock()
+	sc.log.input(p)
+	_, err := utils.WriteAll(conn, p)
+	return err
+}
+
+// detach tells the server the client is disconnecting on purpose.
+func (sc *sshConn) detach() {
+	_, other := sc.getConns()
+	other.Write([]byte{common.ActionDetach})
 }
 
-func sshConnToStdout(conn net.Conn) int {
-	ret, buf := 0, make([]byte, 1<<15)
+// sendSignal asks the server to signal the session's foreground process group.
+func (sc *sshConn) sendSignal(sig syscall.Signal) {
+	_, other := sc.getConns()
+	other.Write([]byte{common.ActionSignal, byte(sig)})
+}
+
+func (sc *sshConn) connToStdout(conn net.Conn) (err error) {
+	buf := make([]byte, 1<<15)
 	for {
 		//_, err := io.CopyBuffer(os.Stdout, conn, buf)
-		n, err := conn.Read(buf)
+		var n int
+		n, err = conn.Read(buf)
 		if err != nil {
-			if err != io.EOF {
-				log.Print("\nError reading: ", err)
-				ret = 1
+			if err == io.EOF {
+				err = nil
 			}
-			break
+			return
 		}
 		os.Stdout.Write(buf[:n])
+		sc.log.output(buf[:n])
+		sc.outOffset += uint64(n)
 	}
-	term.Restore(int(os.Stdin.Fd()), termState)
-	return ret
 }
 
-func sshStdinToConn(conn net.Conn) {
+// reconnect resumes the session over new connections, retrying until the
+// reconnect timeout passes or the server rejects resuming.
+func (sc *sshConn) reconnect(
+	addr string, isTerm bool,
+) (conn, other net.Conn, err error) {
+	log.Print("\r\n===Connection lost, reconnecting...===\r")
+	deadline := time.Now().Add(reconnectTimeout)
+	for {
+		req := common.SshReq{
+			Resume:     sc.token,
+			Offset:     sc.outOffset,
+			EchoEvents: sshReq.EchoEvents,
+		}
+		var resp common.AttachResp
+		conn, other, resp, err = openSsh(addr, nil, nil, req, termSize(isTerm))
+		if err == nil {
+			sc.resumed(conn, other, resp)
+			log.Print("\r\n===Reconnected===\r")
+			return
+		}
+		var e *common.Error
+		if errors.As(err, &e) || time.Now().After(deadline) {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// resumed switches to the new connections, resending any input the server
+// didn't receive.
+func (sc *sshConn) resumed(conn, other net.Conn, resp common.AttachResp) {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	sc.conn, sc.other = conn, other
+	if resp.Offset > sc.outOffset {
+		log.Printf(
+			"\r\n===%d bytes of output were lost===\r",
+			resp.Offset-sc.outOffset,
+		)
+	}
+	sc.outOffset = resp.Offset
+	pending, lost := sc.input.Since(resp.InputReceived)
+	if lost != 0 {
+		log.Printf("\r\n===%d bytes of input were lost===\r", lost)
+	}
+	utils.WriteAll(conn, pending)
+}
+
+// inputBuf holds the last bytes of input sent.
+type inputBuf struct {
+	buf []byte
+	max int
+	// The total number of bytes written
+	total uint64
+}
+
+func newInputBuf(max int) *inputBuf {
+	return &inputBuf{max: max}
+}
+
+func (ib *inputBuf) Write(p []byte) {
+	ib.total += uint64(len(p))
+	ib.buf = append(ib.buf, p...)
+	if len(ib.buf) > ib.max {
+		ib.buf = append(ib.buf[:0], ib.buf[len(ib.buf)-ib.max:]...)
+	}
+}
+
+// Since returns the bytes held starting at the given offset in the total
+// bytes written, along with the number of bytes after the offset no longer
+// held.
+func (ib *inputBuf) Since(offset uint64) ([]byte, uint64) {
+	oldest := ib.total - uint64(len(ib.buf))
+	if offset >= ib.total {
+		return nil, 0
+	} else if offset < oldest {
+		return append([]byte(nil), ib.buf...), oldest - offset
+	}
+	return append([]byte(nil), ib.buf[offset-oldest:]...), 0
+}
+
+func restoreTerm() {
+	if termState != nil {
+		term.Restore(int(os.Stdin.Fd()), termState)
+	}
+}
+
+// sshCtrl handles messages sent from the server over the control connection.
+// Its fields should only be read once done is closed.
+type sshCtrl struct {
+	done        chan utils.Unit
+	closed      bool
+	closeReason string
+	exit        *common.ExitStatus
+
+	log *transcript
+}
+
+func newSshCtrl(tr *transcript) *sshCtrl {
+	return &sshCtrl{done: make(chan utils.Unit), log: tr}
+}
+
+func (sc *sshCtrl) run(other net.Conn) {
+	defer close(sc.done)
+	var buf [1]byte
+	for {
+		if _, err := other.Read(buf[:]); err != nil {
+			return
+		}
+		switch buf[0] {
+		case common.ActionClose:
+			reason, err := common.ReadStr16(other)
+			if err != nil {
+				return
+			}
+			sc.closed, sc.closeReason = true, reason
+		case common.ActionExit:
+			es, err := common.ReadExitStatus(other)
+			if err != nil {
+				return
+			}
+			sc.exit = &es
+		case common.ActionEcho:
+			if _, err := io.ReadFull(other, buf[:]); err != nil {
+				return
+			}
+			sc.log.setEchoes(buf[0] != 0)
+		default:
+			return
+		}
+	}
+}
+
+// wait waits for the control connection to be closed, returning false if it
+// timed out.
+func (sc *sshCtrl) wait(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-sc.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func sshStdinToConn(sc *sshConn, esc *sshEscaper) {
 	ret, buf := 0, [1024]byte{}
 	for {
 		//_, err := io.CopyBuffer(conn, os.Stdin, buf[:])
@@ -106,20 +509,39 @@ func sshStdinToConn(conn net.Conn) {
 			if err != io.EOF {
 				log.Print("\nError reading stdin: ", err)
 				ret = 1
+			} else if termState == nil {
+				// Stdin isn't a terminal so send EOT (Ctrl-D) and keep reading output
+				// until the remote shell exits
+				sc.write([]byte{0x04})
+				return
 			}
 			break
 		}
-		if _, err := conn.Write(buf[:n]); err != nil {
+		p := esc.filter(buf[:n])
+		if len(p) == 0 {
+			continue
+		}
+		// If resuming is supported, the input is resent once resumed
+		if err := sc.write(p); err != nil && sc.token == "" {
 			log.Print("\nError writing: ", err)
 			ret = 1
 			break
 		}
 	}
-	term.Restore(int(os.Stdin.Fd()), termState)
+	sc.detach()
+	restoreTerm()
 	os.Exit(ret)
 }
 
-func sshWatchWinSize(other net.Conn, winchCh chan os.Signal) {
+// requestResize has the terminal size sent to the server.
+func requestResize() {
+	select {
+	case winchCh <- syscall.SIGWINCH:
+	default:
+	}
+}
+
+func sshWatchWinSize(sc *sshConn) {
 	var buf [9]byte
 	buf[0] = common.ActionResize
 	for range winchCh {
@@ -128,68 +550,120 @@ func sshWatchWinSize(other net.Conn, winchCh chan os.Signal) {
 			log.Fatal("Error getting terminal size: ", err)
 		}
 		common.WinsizeToBytes(buf[1:], ws)
-		if _, err := other.Write(buf[:]); err != nil {
+		sc.log.resize(ws)
+		// If resuming is supported, the size is sent when resuming
+		_, other := sc.getConns()
+		if _, err := other.Write(buf[:]); err != nil && sc.token == "" {
 			log.Fatal("Error sending terminal size: ", err)
 		}
 	}
 }
 
+// openSsh connects, sends the terminal size, and reads the attach response.
+func openSsh(
+	addr string,
+	mainConn, otherConn net.Conn,
+	req common.SshReq,
+	ws *pty.Winsize,
+) (conn, other net.Conn, resp common.AttachResp, err error) {
+	conn, other, err = connectSsh(addr, mainConn, otherConn, req)
+	if err != nil {
+		return
+	}
+	if _, err = other.Write(common.WinsizeToBytes(nil, ws)); err == nil {
+		resp, err = common.ReadAttachResp(conn)
+	}
+	if err != nil {
+		conn.Close()
+		other.Close()
+	}
+	return
+}
+
 func connectSsh(
-	addr string, mainConn, otherConn net.Conn,
-) (net.Conn, net.Conn) {
+	addr string, mainConn, otherConn net.Conn, req common.SshReq,
+) (conn, other net.Conn, err error) {
 	var idBuf [9]byte
-	conn := connectMainConn(addr, idBuf[:], mainConn)
-	other := connectOtherConn(addr, idBuf[:], otherConn)
-
-	if n, err := conn.Read(idBuf[:8]); err != nil {
-		log.Fatal("Error reading response: ", err)
-	} else if n != 8 {
-		log.Fatal("Expected 8 bytes, got ", n)
+	conn, err = connectMainConn(addr, idBuf[:], mainConn, req)
+	if err != nil {
+		return
 	}
-	if n, err := other.Read(idBuf[:8]); err != nil {
-		log.Fatal("Error reading response: ", err)
-	} else if n != 8 {
-		log.Fatal("Expected 8 bytes, got ", n)
+	other, err = connectOtherConn(addr, idBuf[:], otherConn)
+	if err != nil {
+		conn.Close()
+		return
 	}
 
-	return conn, other
+	if err = readIdResp(conn, idBuf[:8]); err == nil {
+		err = readIdResp(other, idBuf[:8])
+	}
+	if err != nil {
+		conn.Close()
+		other.Close()
+		return nil, nil, fmt.Errorf("error connecting: %w", err)
+	}
+	return
 }
 
-func connectMainConn(addr string, idBuf []byte, conn net.Conn) net.Conn {
+func connectMainConn(
+	addr string, idBuf []byte, conn net.Conn, req common.SshReq,
+) (net.Conn, error) {
 	if conn == nil {
 		var err error
 		conn, err = connectConn(addr)
 		if err != nil {
-			log.Fatal("Error connecting: ", err)
+			return nil, fmt.Errorf("error connecting: %w", err)
 		}
 	}
 	if _, err := conn.Write([]byte{common.HeaderNewSsh}); err != nil {
-		log.Fatal("Error connecting: ", err)
+		conn.Close()
+		return nil, fmt.Errorf("error connecting: %w", err)
+	}
+	if err := common.WriteJsonFrame(conn, req); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error connecting: %w", err)
 	}
-	if n, err := conn.Read(idBuf[1:]); err != nil {
-		log.Fatal("Error getting ID: ", err)
-	} else if n != 8 {
-		log.Fatal("Expected 8 bytes for ID, got ", n)
+	if err := readIdResp(conn, idBuf[1:]); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error getting ID: %w", err)
 	}
-	return conn
+	return conn, nil
 }
 
-func connectOtherConn(addr string, idBuf []byte, other net.Conn) net.Conn {
+func connectOtherConn(
+	addr string, idBuf []byte, other net.Conn,
+) (net.Conn, error) {
 	if other == nil {
 		var err error
 		other, err = connectConn(addr)
 		if err != nil {
-			log.Fatal("Error connecting: ", err)
+			return nil, fmt.Errorf("error connecting: %w", err)
 		}
 	}
 	idBuf[0] = common.HeaderJoinSsh
 	if _, err := other.Write(idBuf[:]); err != nil {
-		log.Fatal("Error sending ID: ", err)
+		other.Close()
+		return nil, fmt.Errorf("error sending ID: %w", err)
+	}
+	return other, nil
+}
+
+// readIdResp reads a response followed by an 8-byte ID into idBuf.
+func readIdResp(conn net.Conn, idBuf []byte) error {
+	if err := common.ReadResp(conn); err != nil {
+		return err
 	}
-	return other
+	_, err := io.ReadFull(conn, idBuf[:8])
+	return err
 }
 
 func connectConn(addr string) (conn net.Conn, err error) {
+	return connectConnType(addr, common.TcpSsh)
+}
+
+// connectConnType connects and logs in, reading the password if it hasn't
+// been already.
+func connectConnType(addr string, what byte) (conn net.Conn, err error) {
 	closeConn := utils.NewT(true)
 	defer func() {
 		if *closeConn && conn != nil {
@@ -197,13 +671,13 @@ func connectConn(addr string) (conn net.Conn, err error) {
 		}
 	}()
 
-	conn, err = dialConn(addr, common.TcpSsh)
+	conn, err = dialConn(addr, what)
 	if err != nil {
 		return nil, err
 	}
 	// NOTE: Refactor?
 	if !gotPassword {
-		if password, err = getPassword(); err != nil {
+		if password, err = getPassword(addr); err != nil {
 			log.Fatal("Error reading password: ", err)
 		}
 		gotPassword = true
@@ -0,0 +1,136 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/johnietre/gossh/common"
+	"github.com/spf13/pflag"
+)
+
+var (
+	// Path of the file to log the session to
+	logPath string
+	// Either "" (input isn't logged), "all", or "redacted"
+	logInput string
+)
+
+func addLogFlags(flags *pflag.FlagSet) {
+	flags.StringVar(
+		&logPath, "log", "",
+		"Log the session to a local file as an asciicast v2 recording (can be played with \"replay\")",
+	)
+	flags.StringVar(
+		&logInput, "log-input", "",
+		`Also log typed input, either "all" or "redacted" (the default if no value is given), which skips input while the remote terminal isn't echoing it (e.g., passwords)`,
+	)
+	flags.Lookup("log-input").NoOptDefVal = "redacted"
+}
+
+// transcript logs a session to a local file. A nil transcript logs nothing.
+type transcript struct {
+	mtx sync.Mutex
+	f   *os.File
+	cw  *common.CastWriter
+	// Whether the remote terminal is echoing input, as last told by the
+	// server. Input is assumed hidden until told otherwise.
+	echoes bool
+}
+
+// openTranscript opens the log file, if one was given.
+func openTranscript() *transcript {
+	if logPath == "" {
+		if logInput != "" {
+			log.Fatal("--log-input requires --log")
+		}
+		return nil
+	} else if logInput != "" && logInput != "all" && logInput != "redacted" {
+		log.Fatalf("Invalid --log-input %q: must be all or redacted", logInput)
+	}
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Fatal("Error opening log file: ", err)
+	}
+	return &transcript{f: f}
+}
+
+// start writes the header once connected.
+func (t *transcript) start(session uint64, ws *pty.Winsize) {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	now := time.Now()
+	header := common.CastHeader{
+		Version:   2,
+		Width:     ws.Cols,
+		Height:    ws.Rows,
+		Timestamp: now.Unix(),
+		Title:     fmt.Sprintf("gossh session %d", session),
+		Session:   session,
+	}
+	if term := os.Getenv("TERM"); term != "" {
+		header.Env = map[string]string{"TERM": term}
+	}
+	cw, err := common.NewCastWriter(t.f, header, now)
+	t.cw = cw
+	t.checkErrLocked(err)
+}
+
+func (t *transcript) output(p []byte) {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.cw != nil {
+		t.checkErrLocked(t.cw.Output(p))
+	}
+}
+
+func (t *transcript) input(p []byte) {
+	if t == nil || logInput == "" {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.cw != nil && (t.echoes || logInput == "all") {
+		t.checkErrLocked(t.cw.Input(p))
+	}
+}
+
+func (t *transcript) resize(ws *pty.Winsize) {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.cw != nil {
+		t.checkErrLocked(t.cw.Resize(*ws))
+	}
+}
+
+func (t *transcript) setEchoes(echoes bool) {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.echoes = echoes
+}
+
+// checkErrLocked stops logging if there was an error. Must be called with the
+// lock held.
+func (t *transcript) checkErrLocked(err error) {
+	if err == nil {
+		return
+	}
+	log.Print("\r\nError writing log, no longer logging: ", err, "\r")
+	t.cw = nil
+	t.f.Close()
+}
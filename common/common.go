@@ -3,11 +3,18 @@ package common
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/creack/pty"
 	utils "github.com/johnietre/utils/go"
@@ -16,11 +23,16 @@ import (
 const (
 	AddrEnvName     = "GOSSH_ADDR"
 	PasswordEnvName = "GOSSH_PASSWORD"
+	UserEnvName     = "GOSSH_USER"
+	// OriginalCommandEnvName is set to the requested command when a user's
+	// forced command is run instead.
+	OriginalCommandEnvName = "GOSSH_ORIGINAL_COMMAND"
 )
 
 // HTTP specific
 const (
 	HttpPasswordHeader = "Gossh-Password"
+	HttpUserHeader     = "Gossh-User"
 )
 
 // Initial TCP specific
@@ -29,6 +41,9 @@ const (
 	TcpSsh     byte = 1
 	TcpProcs   byte = 2
 	TcpFiles   byte = 3
+	TcpForward byte = 4
+	// TcpBanner gets the server's pre-auth banner (str16) without logging in.
+	TcpBanner byte = 5
 )
 
 // Stream responses
@@ -42,6 +57,10 @@ const (
 	RespErrNotExist        byte = 129
 	RespErrPasswordInvalid byte = 130
 	RespErrPasswordError   byte = 131
+	RespErrBadRequest      byte = 132
+	RespErrTimeout         byte = 133
+	RespErrUnsupported     byte = 134
+	RespErrPermission      byte = 135
 )
 
 // SSH specific
@@ -50,15 +69,122 @@ const (
 	HeaderJoinSsh byte = 2
 
 	ActionResize byte = 3
+
+	HeaderListSsh byte = 4
+	HeaderKillSsh byte = 5
+
+	// Sent from the server, followed by the reason (see AppendStr16)
+	ActionClose byte = 6
+
+	HeaderShareSsh byte = 7
+
+	// Sent from the server, followed by the exit status (see
+	// AppendExitStatus)
+	ActionExit byte = 8
+
+	HeaderExecSsh byte = 9
+
+	// Sent from the client before disconnecting on purpose, so the server
+	// doesn't wait for it to resume
+	ActionDetach byte = 10
+
+	// Sent from the client, followed by the signal number (byte), to signal
+	// the session's foreground process group
+	ActionSignal byte = 11
+
+	// Sent from the server to clients that asked for echo events, followed by
+	// 0 if typed input isn't being echoed (e.g., a password is being read) and
+	// 1 otherwise. Sent once attached and whenever it changes.
+	ActionEcho byte = 12
+)
+
+// Exec specific. After HeaderExecSsh, data is sent in frames (see
+// AppendExecFrame).
+const (
+	ExecStdin  byte = 1
+	ExecStdout byte = 2
+	ExecStderr byte = 3
+	// Followed by the exit status (see AppendExitStatus)
+	ExecExit byte = 4
+	// Sent from the client, with the signal number (byte) as the data, to
+	// signal the command's process group
+	ExecSignal byte = 5
+
+	// The max length of the data in an exec frame
+	MaxExecFrameLen = 1 << 20
 )
 
 // Procs specific
 const (
-	HeaderGetProc  byte = 1
+	// Followed by a GetProcReq JSON frame. The server responds with the
+	// process as a JSON frame.
+	HeaderGetProc byte = 1
+	// Followed by a GetProcsReq JSON frame. The server responds with the
+	// matching processes as a JSON frame.
 	HeaderGetProcs byte = 2
 	HeaderAddProc  byte = 3
+	// Followed by the 8-byte process ID and the signal number (byte)
+	HeaderSignalProc byte = 4
+	// Followed by the 8-byte process ID. The server responds once the process
+	// exits, followed by the exit status (see AppendExitStatus).
+	HeaderWaitProc byte = 5
+	// Followed by a ProcLogsReq JSON frame. The server responds with each line
+	// of output as a ProcLogLine JSON frame, closing the connection after the
+	// last.
+	HeaderProcLogs byte = 6
+	// Followed by a PurgeProcsReq JSON frame. The server responds with a JSON
+	// frame of the IDs of the processes removed.
+	HeaderPurgeProcs byte = 7
 )
 
+// Forward specific
+const (
+	// Followed by a ForwardReq JSON frame. The server connects to the target
+	// and responds, after which the connection carries the forwarded data.
+	HeaderForwardDial byte = 1
+	// Followed by a ForwardReq JSON frame with the address for the server to
+	// listen on. The server responds with the address it's listening on (see
+	// AppendStr16) and sends ActionForwardConn for each accepted connection
+	// while the connection stays open.
+	HeaderForwardListen byte = 2
+	// Followed by the 8-byte ID of a connection sent in ActionForwardConn.
+	// After the response, the connection carries the forwarded data.
+	HeaderForwardAccept byte = 3
+	// Sent from the server, followed by the 8-byte ID of the accepted
+	// connection.
+	ActionForwardConn byte = 4
+)
+
+// ForwardReq is a request to forward a connection.
+type ForwardReq struct {
+	// Addr is the host:port to connect to (or listen on).
+	Addr string `json:"addr"`
+}
+
+// Pipe copies data between the connections in both directions, closing both
+// once done. When one direction finishes, the write side of the other
+// connection is closed if possible so half-closed connections work.
+func Pipe(a, b net.Conn) {
+	done := make(chan utils.Unit, 1)
+	go func() {
+		pipeOneWay(a, b)
+		done <- utils.Unit{}
+	}()
+	pipeOneWay(b, a)
+	<-done
+	a.Close()
+	b.Close()
+}
+
+func pipeOneWay(dst, src net.Conn) {
+	io.Copy(dst, src)
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
 // Files specific
 const (
 	HeaderSendFiles byte = 1
@@ -100,8 +226,26 @@ func WinsizeToBytes(b []byte, ws *pty.Winsize) []byte {
 
 type Procs = []*Process
 
+// Special values of a process's Stdin, Stdout, and Stderr. Any other value
+// is a file path, relative to the process's directory, optionally prefixed
+// with ">" to truncate (the default) or ">>" to append for output or "<" for
+// input. Files named like the special values can be given as ./NAME.
 const (
+	// Pipes the stdio to the client, like an SSH session. Must be used for
+	// all three.
 	ProcPipe = "|"
+	// Discards output or gives no input. Same as an empty value.
+	ProcNull = "null"
+	// Appends output to a log file in the server's procs log directory.
+	ProcLog = "log"
+	// Only for Stderr, sends it wherever Stdout goes.
+	ProcStdout = "stdout"
+)
+
+// Process statuses
+const (
+	ProcRunning = "running"
+	ProcExited  = "exited"
 )
 
 type Process struct {
@@ -116,10 +260,29 @@ type Process struct {
 	Stdout     string   `json:"stdout"`
 	Stderr     string   `json:"stderr"`
 	Stdin      string   `json:"stdin"`
+	// LogFile is the path of the log file on the server if Stdout or Stderr
+	// is ProcLog.
+	LogFile string `json:"logFile,omitempty"`
 
-	cmd        *exec.Cmd
-	procs      *utils.RWMutex[Procs]
+	// The following are set once the process has exited.
+	End int64 `json:"end,omitempty"`
+	// Runtime is how long the process ran, in seconds.
+	Runtime float64     `json:"runtime,omitempty"`
+	Exit    *ExitStatus `json:"exit,omitempty"`
+	// Output is the last lines of output, if it was captured.
+	Output []ProcLogLine `json:"output,omitempty"`
+
+	// WaitOutput, if set, is called once the process has exited, before the
+	// files opened for its stdio are closed, to wait for any output still
+	// being copied to them.
+	WaitOutput func() `json:"-"`
+
+	cmd     *exec.Cmd
+	started time.Time
+	// Files opened for the stdio, closed once the process exits
+	files      []*os.File
 	closedChan chan utils.Unit
+	procs      *utils.RWMutex[Procs]
 	err        *utils.AValue[utils.ErrorValue]
 }
 
@@ -130,29 +293,151 @@ func (p *Process) CmdEnv() []string {
 	return p.cmd.Env
 }
 
-func (p *Process) PopulateCmd() *exec.Cmd {
+// IsPipe returns whether the stdio is piped to the client.
+func (p *Process) IsPipe() bool {
+	return p.Stdin == ProcPipe && p.Stdout == ProcPipe && p.Stderr == ProcPipe
+}
+
+// PopulateCmd creates the command, opening any files for the stdio. ProcLog
+// files are created in logDir, which if empty makes ProcLog unsupported. Once
+// created, the same command is returned.
+func (p *Process) PopulateCmd(logDir string) (*exec.Cmd, error) {
 	if p.cmd != nil {
-		return p.cmd
+		return p.cmd, nil
 	}
-	p.cmd = exec.Command(p.Program, p.Args...)
-	p.cmd.Dir = p.Dir
+	cmd := exec.Command(p.Program, p.Args...)
+	cmd.Dir = p.Dir
 	if p.InheritEnv {
-		p.cmd.Env = os.Environ()
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, p.Env...)
+	if !p.IsPipe() {
+		if err := p.openStdio(cmd, logDir); err != nil {
+			p.closeFiles()
+			return nil, err
+		}
 	}
-	p.cmd.Env = append(p.cmd.Env, p.Env...)
+	p.cmd = cmd
 	p.closedChan = make(chan utils.Unit)
 	p.err = utils.NewAValue(utils.ErrorValue{})
-	return p.cmd
+	return p.cmd, nil
+}
+
+func (p *Process) openStdio(cmd *exec.Cmd, logDir string) error {
+	// Files opened for output, by path, so output to the same file is shared
+	opened := make(map[string]*os.File)
+	openOut := func(name, val string) (*os.File, error) {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		switch {
+		case val == "" || val == ProcNull:
+			return nil, nil
+		case val == ProcLog:
+			if logDir == "" {
+				return nil, NewError(
+					RespErrUnsupported, "server has no procs log directory",
+				)
+			}
+			if p.LogFile == "" {
+				p.LogFile = filepath.Join(logDir, fmt.Sprintf(
+					"%s-%d.log", time.Now().Format("20060102-150405"), p.Id,
+				))
+			}
+			val, flags = p.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND
+		case val == ProcPipe:
+			return nil, NewError(
+				RespErrBadRequest, "stdin, stdout, and stderr must all be piped",
+			)
+		case strings.HasPrefix(val, ">>"):
+			val, flags = val[2:], os.O_WRONLY|os.O_CREATE|os.O_APPEND
+		case strings.HasPrefix(val, ">"):
+			val = val[1:]
+		}
+		path := p.resolvePath(val)
+		if f := opened[path]; f != nil {
+			return f, nil
+		}
+		f, err := os.OpenFile(path, flags, 0644)
+		if err != nil {
+			return nil, NewError(
+				RespErrBadRequest, fmt.Sprintf("error opening %s: %v", name, err),
+			)
+		}
+		p.files = append(p.files, f)
+		opened[path] = f
+		return f, nil
+	}
+
+	switch p.Stdin {
+	case "", ProcNull:
+	case ProcPipe:
+		return NewError(
+			RespErrBadRequest, "stdin, stdout, and stderr must all be piped",
+		)
+	case ProcLog, ProcStdout:
+		return NewError(
+			RespErrBadRequest, fmt.Sprintf("invalid stdin %q", p.Stdin),
+		)
+	default:
+		f, err := os.Open(p.resolvePath(strings.TrimPrefix(p.Stdin, "<")))
+		if err != nil {
+			return NewError(
+				RespErrBadRequest, fmt.Sprintf("error opening stdin: %v", err),
+			)
+		}
+		p.files = append(p.files, f)
+		cmd.Stdin = f
+	}
+
+	if p.Stdout == ProcStdout {
+		return NewError(RespErrBadRequest, "stdout can't be sent to stdout")
+	}
+	stdout, err := openOut("stdout", p.Stdout)
+	if err != nil {
+		return err
+	} else if stdout != nil {
+		cmd.Stdout = stdout
+	}
+	if p.Stderr == ProcStdout {
+		cmd.Stderr = cmd.Stdout
+		return nil
+	}
+	stderr, err := openOut("stderr", p.Stderr)
+	if err != nil {
+		return err
+	} else if stderr != nil {
+		cmd.Stderr = stderr
+	}
+	return nil
+}
+
+// resolvePath resolves the path relative to the process's directory.
+func (p *Process) resolvePath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(p.Dir, path)
+}
+
+// closeFiles closes the files opened for the stdio.
+func (p *Process) closeFiles() {
+	for _, f := range p.files {
+		f.Close()
+	}
+	p.files = nil
 }
 
 func (p *Process) Run(procs *utils.RWMutex[Procs]) error {
-	p.PopulateCmd()
+	if _, err := p.PopulateCmd(""); err != nil {
+		return err
+	}
 	p.procs = procs
 	// Clear env so it isn't sent every time it's serialized
 	p.Env = nil
 
-	p.Start = time.Now().Unix()
+	p.started = time.Now()
+	p.Start = p.started.Unix()
 	if err := p.cmd.Start(); err != nil {
+		p.closeFiles()
 		return err
 	}
 	go p.watch()
@@ -164,18 +449,60 @@ func (p *Process) Wait() error {
 	return p.err.Load().Error
 }
 
+// Status returns the status of the process (ProcRunning or ProcExited).
+func (p *Process) Status() string {
+	select {
+	case <-p.closedChan:
+		return ProcExited
+	default:
+		return ProcRunning
+	}
+}
+
+// Done returns a channel that's closed once the process exits.
+func (p *Process) Done() <-chan utils.Unit {
+	return p.closedChan
+}
+
 func (p *Process) watch() {
 	err := p.cmd.Wait()
+	// Kept open until now since the output may be copied to the files
+	// (rather than the files being given to the process) if it's captured
+	if p.WaitOutput != nil {
+		p.WaitOutput()
+	}
+	p.closeFiles()
+	end := time.Now()
 	p.err.Store(utils.NewErrorValue(err))
-	close(p.closedChan)
-	p.procs.Apply(func(pp *Procs) {
-		for i, proc := range *pp {
-			if proc.Id == p.Id {
-				*pp = append((*pp)[:i], (*pp)[i+1:]...)
-				return
-			}
+	// The process is kept in the list so its exit can be looked up; it's up to
+	// the owner of the list to remove it
+	p.procs.Apply(func(*Procs) {
+		p.End = end.Unix()
+		p.Runtime = end.Sub(p.started).Seconds()
+		if p.cmd.ProcessState != nil {
+			es := ExitStatusFromState(p.cmd.ProcessState)
+			p.Exit = &es
 		}
 	})
+	close(p.closedChan)
+}
+
+// ExitStatus returns the exit status of the process, or false if it hasn't
+// exited.
+func (p *Process) ExitStatus() (ExitStatus, bool) {
+	if p.cmd == nil {
+		return ExitStatus{}, false
+	}
+	// ProcessState is only safe to read once Wait has returned
+	select {
+	case <-p.closedChan:
+	default:
+		return ExitStatus{}, false
+	}
+	if p.cmd.ProcessState == nil {
+		return ExitStatus{}, false
+	}
+	return ExitStatusFromState(p.cmd.ProcessState), true
 }
 
 func (p *Process) Signal(sig syscall.Signal) error {
@@ -186,3 +513,433 @@ func (p *Process) Signal(sig syscall.Signal) error {
 	}
 	return p.cmd.Process.Signal(sig)
 }
+
+// GetProcReq is sent by the client after HeaderGetProc.
+type GetProcReq struct {
+	Id uint64 `json:"id"`
+	// Env is whether to include the process's environment.
+	Env bool `json:"env,omitempty"`
+}
+
+// GetProcsReq is sent by the client after HeaderGetProcs.
+type GetProcsReq struct {
+	// Name, if set, is a pattern (see path.Match) the process names must match.
+	Name string `json:"name,omitempty"`
+	// Status, if set, is the status the processes must have.
+	Status string `json:"status,omitempty"`
+	// Env is whether to include the processes' environments.
+	Env bool `json:"env,omitempty"`
+}
+
+// ProcLogsReq is sent by the client after HeaderProcLogs.
+type ProcLogsReq struct {
+	Id uint64 `json:"id"`
+	// Follow is whether to keep sending output until the process exits.
+	Follow bool `json:"follow,omitempty"`
+	// Tail, if positive, is the number of lines from the end to start at.
+	Tail int `json:"tail,omitempty"`
+	// Since, if set, is the time lines must have been output at or after.
+	Since time.Time `json:"since"`
+	// After, if set, is the sequence number of the last line already received
+	// (e.g., when resuming), with lines starting after it regardless of Tail
+	// and Since.
+	After *uint64 `json:"after,omitempty"`
+}
+
+// PurgeProcsReq is sent by the client after HeaderPurgeProcs.
+type PurgeProcsReq struct {
+	// Ids are the exited processes to remove from the history. If empty, all
+	// exited processes are removed.
+	Ids []uint64 `json:"ids,omitempty"`
+}
+
+// ProcLogLine is a line of a process's output.
+type ProcLogLine struct {
+	// Seq is the number of lines output before this one.
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	// Stream is either "stdout" or "stderr".
+	Stream string `json:"stream"`
+	Text   string `json:"text"`
+}
+
+// SshReq is sent by the client after HeaderNewSsh.
+type SshReq struct {
+	// Name is the name of the session. Named sessions are persistent.
+	Name string `json:"name,omitempty"`
+	// Persist is whether the session should stay alive after the client
+	// disconnects.
+	Persist bool `json:"persist,omitempty"`
+	// Attach is the ID or name of an existing session to attach to.
+	Attach string `json:"attach,omitempty"`
+	// ReadOnly is whether to attach without being able to write.
+	ReadOnly bool `json:"readOnly,omitempty"`
+	// DetachOthers is whether to detach all other clients when attaching.
+	DetachOthers bool `json:"detachOthers,omitempty"`
+	// Shares maps usernames to whether they can write when attaching to the
+	// new session.
+	Shares map[string]bool `json:"shares,omitempty"`
+	// Env holds environment variables to set for the new session. Only those
+	// accepted by the server are set.
+	Env map[string]string `json:"env,omitempty"`
+	// Dir is the directory to start the new session in. Relative paths are
+	// relative to the server's SSH directory.
+	Dir string `json:"dir,omitempty"`
+	// Command is the program and its args to run instead of the shell.
+	Command []string `json:"command,omitempty"`
+	// Resume is the resume token of a lost connection to resume.
+	Resume string `json:"resume,omitempty"`
+	// Offset is the number of bytes of session output received before the
+	// connection was lost, when resuming.
+	Offset uint64 `json:"offset,omitempty"`
+	// EchoEvents is whether to be sent ActionEcho on the control connection.
+	EchoEvents bool `json:"echoEvents,omitempty"`
+}
+
+// AttachResp is sent by the server once attached to a session, followed by
+// the session output starting at Offset.
+type AttachResp struct {
+	Session uint64
+	// Offset is the offset in the session's output of the output that follows.
+	Offset uint64
+	// Token is used to resume if the connection is lost. It's empty if
+	// resuming isn't supported.
+	Token string
+	// InputReceived is the number of bytes of input the server has received
+	// from the client, across resumed connections.
+	InputReceived uint64
+}
+
+// AppendAttachResp appends RespOk followed by the response.
+func AppendAttachResp(b []byte, resp AttachResp) []byte {
+	b = binary.LittleEndian.AppendUint64(append(b, RespOk), resp.Session)
+	b = binary.LittleEndian.AppendUint64(b, resp.Offset)
+	b = AppendStr16(b, resp.Token)
+	return binary.LittleEndian.AppendUint64(b, resp.InputReceived)
+}
+
+// ReadAttachResp reads a response written by AppendAttachResp, returning an
+// *Error if an error frame was sent.
+func ReadAttachResp(r io.Reader) (resp AttachResp, err error) {
+	if err = ReadResp(r); err != nil {
+		return
+	}
+	var buf [16]byte
+	if _, err = io.ReadFull(r, buf[:]); err != nil {
+		return
+	}
+	resp.Session = binary.LittleEndian.Uint64(buf[:8])
+	resp.Offset = binary.LittleEndian.Uint64(buf[8:])
+	if resp.Token, err = ReadStr16(r); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(r, buf[:8]); err != nil {
+		return
+	}
+	resp.InputReceived = binary.LittleEndian.Uint64(buf[:8])
+	return
+}
+
+// SessionInfo describes a running SSH session.
+type SessionInfo struct {
+	Id       uint64 `json:"id"`
+	Name     string `json:"name,omitempty"`
+	User     string `json:"user"`
+	Peer     string `json:"peer,omitempty"`
+	Start    int64  `json:"start"`
+	Command  string `json:"command"`
+	Rows     uint16 `json:"rows"`
+	Cols     uint16 `json:"cols"`
+	BytesIn  uint64 `json:"bytesIn"`
+	BytesOut uint64 `json:"bytesOut"`
+	Persist  bool   `json:"persist,omitempty"`
+	Attached bool   `json:"attached"`
+
+	Clients []SessionClientInfo `json:"clients"`
+	// Maps usernames to whether they can write
+	Shares map[string]bool `json:"shares,omitempty"`
+}
+
+// SessionClientInfo describes a client attached to an SSH session.
+type SessionClientInfo struct {
+	User string `json:"user"`
+	Peer string `json:"peer,omitempty"`
+	// One of "owner", "write", or "read"
+	Mode string `json:"mode"`
+}
+
+// KillSessionReq is sent by the client after HeaderKillSsh.
+type KillSessionReq struct {
+	// Session is the ID or name of the session.
+	Session string `json:"session"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// ShareSessionReq is sent by the client after HeaderShareSsh.
+type ShareSessionReq struct {
+	// Session is the ID or name of the session.
+	Session string `json:"session"`
+	User    string `json:"user"`
+	// Write is whether the user can write to the session.
+	Write bool `json:"write,omitempty"`
+	// Remove is whether to stop sharing the session with the user.
+	Remove bool `json:"remove,omitempty"`
+}
+
+// CastHeader is the header of an asciicast v2 recording, with additional
+// gossh-specific fields.
+type CastHeader struct {
+	Version   int               `json:"version"`
+	Width     uint16            `json:"width"`
+	Height    uint16            `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+
+	Session uint64 `json:"gossh_session,omitempty"`
+	User    string `json:"gossh_user,omitempty"`
+	Name    string `json:"gossh_name,omitempty"`
+}
+
+// CastWriter writes an asciicast v2 recording.
+type CastWriter struct {
+	w     io.Writer
+	start time.Time
+	// Trailing bytes of an incomplete UTF-8 sequence, by event code
+	partial map[string][]byte
+}
+
+// NewCastWriter writes the header and returns a writer for events timed from
+// start.
+func NewCastWriter(
+	w io.Writer, header CastHeader, start time.Time,
+) (*CastWriter, error) {
+	b, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(b, '\n')); err != nil {
+		return nil, err
+	}
+	return &CastWriter{w: w, start: start, partial: make(map[string][]byte)}, nil
+}
+
+// Output writes an output event.
+func (cw *CastWriter) Output(p []byte) error {
+	return cw.text("o", p)
+}
+
+// Input writes an input event.
+func (cw *CastWriter) Input(p []byte) error {
+	return cw.text("i", p)
+}
+
+// Resize writes a resize event.
+func (cw *CastWriter) Resize(sz pty.Winsize) error {
+	return cw.Event("r", fmt.Sprintf("%dx%d", sz.Cols, sz.Rows))
+}
+
+func (cw *CastWriter) text(code string, p []byte) error {
+	if partial := cw.partial[code]; len(partial) != 0 {
+		p = append(partial, p...)
+		delete(cw.partial, code)
+	}
+	// Hold onto any incomplete UTF-8 sequence at the end so it isn't mangled
+	for i := 1; i < utf8.UTFMax && i <= len(p); i++ {
+		if !utf8.RuneStart(p[len(p)-i]) {
+			continue
+		}
+		if !utf8.FullRune(p[len(p)-i:]) {
+			cw.partial[code] = append([]byte(nil), p[len(p)-i:]...)
+			p = p[:len(p)-i]
+		}
+		break
+	}
+	if len(p) == 0 {
+		return nil
+	}
+	return cw.Event(code, string(p))
+}
+
+// Event writes an event with the given code.
+func (cw *CastWriter) Event(code, data string) error {
+	t := time.Since(cw.start).Seconds()
+	b, err := json.Marshal([]any{t, code, data})
+	if err != nil {
+		return err
+	}
+	_, err = cw.w.Write(append(b, '\n'))
+	return err
+}
+
+// Flush writes any held incomplete UTF-8 sequences.
+func (cw *CastWriter) Flush() error {
+	for code, partial := range cw.partial {
+		delete(cw.partial, code)
+		if err := cw.Event(code, string(partial)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordingInfo describes a session recording on the server.
+type RecordingInfo struct {
+	Name    string `json:"name"`
+	Session uint64 `json:"session"`
+	User    string `json:"user"`
+	Start   int64  `json:"start"`
+	Size    int64  `json:"size"`
+}
+
+// ExecReq is sent by the client after HeaderExecSsh.
+type ExecReq struct {
+	// Command is the program and its args.
+	Command []string `json:"command"`
+	// Env and Dir are the same as in SshReq.
+	Env map[string]string `json:"env,omitempty"`
+	Dir string            `json:"dir,omitempty"`
+}
+
+// AppendExecFrame appends an exec frame consisting of the type, the length
+// of the data (uint32), and the data. Empty stdin frames signal EOF.
+func AppendExecFrame(b []byte, typ byte, data []byte) []byte {
+	b = binary.LittleEndian.AppendUint32(append(b, typ), uint32(len(data)))
+	return append(b, data...)
+}
+
+// ReadExecFrame reads a frame written by AppendExecFrame.
+func ReadExecFrame(r io.Reader) (typ byte, data []byte, err error) {
+	var buf [5]byte
+	if _, err = io.ReadFull(r, buf[:]); err != nil {
+		return
+	}
+	typ = buf[0]
+	l := binary.LittleEndian.Uint32(buf[1:])
+	if l > MaxExecFrameLen {
+		err = fmt.Errorf("exec frame too large: %d", l)
+		return
+	}
+	data = make([]byte, l)
+	_, err = io.ReadFull(r, data)
+	return
+}
+
+// ExitStatus is how a remote process exited.
+type ExitStatus struct {
+	Code int `json:"code"`
+	// Signal is the signal that terminated the process, if any.
+	Signal int `json:"signal,omitempty"`
+}
+
+// SignalNames maps signals to their names, without the SIG prefix.
+var SignalNames = map[syscall.Signal]string{
+	syscall.SIGABRT: "ABRT",
+	syscall.SIGALRM: "ALRM",
+	syscall.SIGFPE:  "FPE",
+	syscall.SIGHUP:  "HUP",
+	syscall.SIGILL:  "ILL",
+	syscall.SIGINT:  "INT",
+	syscall.SIGKILL: "KILL",
+	syscall.SIGPIPE: "PIPE",
+	syscall.SIGQUIT: "QUIT",
+	syscall.SIGSEGV: "SEGV",
+	syscall.SIGTERM: "TERM",
+}
+
+// ParseSignal parses a signal number or name, with or without the SIG prefix.
+func ParseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.ParseUint(s, 10, 8); err == nil && n != 0 {
+		return syscall.Signal(n), nil
+	}
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	for sig, sigName := range SignalNames {
+		if sigName == name {
+			return sig, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid signal %q", s)
+}
+
+// ParseSince parses either an RFC 3339 time or a duration before now.
+func ParseSince(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("invalid since %q: must be a time or duration", s)
+	}
+	return now.Add(-d), nil
+}
+
+// ExitStatusFromState gets the exit status from the process state.
+func ExitStatusFromState(state *os.ProcessState) ExitStatus {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return ExitStatus{Code: -1, Signal: int(ws.Signal())}
+	}
+	return ExitStatus{Code: state.ExitCode()}
+}
+
+// ExitCode returns the exit code that should be used locally, mapping signals
+// to 128+N.
+func (es ExitStatus) ExitCode() int {
+	if es.Signal != 0 {
+		return 128 + es.Signal
+	}
+	return es.Code
+}
+
+func (es ExitStatus) String() string {
+	if es.Signal != 0 {
+		return fmt.Sprintf("killed by signal %d", es.Signal)
+	}
+	return fmt.Sprintf("exit code %d", es.Code)
+}
+
+// AppendExitStatus appends the exit status as the code (int32) followed by
+// the signal (uint8).
+func AppendExitStatus(b []byte, es ExitStatus) []byte {
+	b = binary.LittleEndian.AppendUint32(b, uint32(int32(es.Code)))
+	return append(b, byte(es.Signal))
+}
+
+// ReadExitStatus reads an exit status written by AppendExitStatus.
+func ReadExitStatus(r io.Reader) (es ExitStatus, err error) {
+	var buf [5]byte
+	if _, err = io.ReadFull(r, buf[:]); err != nil {
+		return
+	}
+	es.Code = int(int32(binary.LittleEndian.Uint32(buf[:4])))
+	es.Signal = int(buf[4])
+	return
+}
+
+// WriteJsonFrame writes the JSON encoding of v prefixed with its length
+// (uint64).
+func WriteJsonFrame(w io.Writer, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = utils.WriteAll(
+		w,
+		append(binary.LittleEndian.AppendUint64(nil, uint64(len(b))), b...),
+	)
+	return err
+}
+
+// ReadJsonFrame reads a frame written by WriteJsonFrame into v.
+func ReadJsonFrame(r io.Reader, v any) error {
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return err
+	}
+	lr := &io.LimitedReader{R: r, N: int64(binary.LittleEndian.Uint64(buf[:]))}
+	if err := json.NewDecoder(lr).Decode(v); err != nil {
+		return err
+	}
+	// Discard anything left over
+	_, err := io.Copy(io.Discard, lr)
+	return err
+}
@@ -0,0 +1,181 @@
+package common
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	utils "github.com/johnietre/utils/go"
+)
+
+var (
+	ErrNotExist        = NewError(RespErrNotExist, "")
+	ErrPasswordInvalid = NewError(RespErrPasswordInvalid, "")
+	ErrPasswordError   = NewError(RespErrPasswordError, "")
+	ErrBadRequest      = NewError(RespErrBadRequest, "")
+	ErrTimeout         = NewError(RespErrTimeout, "")
+	ErrUnsupported     = NewError(RespErrUnsupported, "")
+	ErrPermission      = NewError(RespErrPermission, "")
+)
+
+// Error is an error sent between the server and client. Over TCP and
+// websockets, it is sent as a frame consisting of the code followed by the
+// message and details, each prefixed with their length (uint16). Over HTTP,
+// it is sent as JSON.
+type Error struct {
+	Code    byte   `json:"code"`
+	Message string `json:"message,omitempty"`
+	Details string `json:"details,omitempty"`
+}
+
+func NewError(code byte, msg string) *Error {
+	return &Error{Code: code, Message: msg}
+}
+
+// ErrorFrom converts the given error to an *Error, mapping it to the
+// appropriate code where possible.
+func ErrorFrom(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	if os.IsNotExist(err) {
+		return NewError(RespErrNotExist, err.Error())
+	}
+	return NewError(RespErr, err.Error())
+}
+
+func (e *Error) Error() string {
+	s := CodeName(e.Code)
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	if e.Details != "" {
+		s += " (" + e.Details + ")"
+	}
+	return s
+}
+
+// Is reports whether the target is an *Error with the same code.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+func (e *Error) WithDetails(details string) *Error {
+	return &Error{Code: e.Code, Message: e.Message, Details: details}
+}
+
+// AppendFrame appends the error frame to b.
+func (e *Error) AppendFrame(b []byte) []byte {
+	b = append(b, e.Code)
+	b = AppendStr16(b, e.Message)
+	return AppendStr16(b, e.Details)
+}
+
+// AppendStr16 appends the string prefixed with its length (uint16), truncating
+// it if necessary.
+func AppendStr16(b []byte, s string) []byte {
+	if len(s) > 1<<16-1 {
+		s = s[:1<<16-1]
+	}
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// ReadStr16 reads a string written by AppendStr16.
+func ReadStr16(r io.Reader) (string, error) {
+	var lb [2]byte
+	if _, err := io.ReadFull(r, lb[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, binary.LittleEndian.Uint16(lb[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// WriteError writes the error frame for the given error.
+func WriteError(w io.Writer, err error) error {
+	_, err = utils.WriteAll(w, ErrorFrom(err).AppendFrame(nil))
+	return err
+}
+
+// WriteErrorMsg writes an error frame with the given code and message.
+func WriteErrorMsg(w io.Writer, code byte, msg string) error {
+	return WriteError(w, NewError(code, msg))
+}
+
+// ReadError reads the rest of an error frame whose code has already been
+// read.
+func ReadError(r io.Reader, code byte) (*Error, error) {
+	e := &Error{Code: code}
+	var err error
+	if e.Message, err = ReadStr16(r); err != nil {
+		return nil, err
+	}
+	if e.Details, err = ReadStr16(r); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// ReadResp reads a response. It returns nil if the response was RespOk, an
+// *Error if an error frame was sent, or the error encountered while reading.
+func ReadResp(r io.Reader) error {
+	var buf [1]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return err
+	}
+	if buf[0] == RespOk {
+		return nil
+	} else if buf[0] < RespErr {
+		return fmt.Errorf("received unknown response: %d", buf[0])
+	}
+	e, err := ReadError(r, buf[0])
+	if err != nil {
+		return fmt.Errorf("error reading error response: %w", err)
+	}
+	return e
+}
+
+// DecodeHttpError decodes an error sent as JSON in an HTTP response body. If
+// the body isn't a JSON error, the body is used as the message.
+func DecodeHttpError(body []byte, status int) *Error {
+	e := &Error{}
+	if err := json.Unmarshal(body, e); err != nil || e.Code < RespErr {
+		e = NewError(RespErr, string(body))
+		e.Details = fmt.Sprintf("status %d", status)
+	}
+	return e
+}
+
+func CodeName(code byte) string {
+	switch code {
+	case RespErr:
+		return "error"
+	case RespErrNotExist:
+		return "does not exist"
+	case RespErrPasswordInvalid:
+		return "password invalid"
+	case RespErrPasswordError:
+		return "password error"
+	case RespErrBadRequest:
+		return "bad request"
+	case RespErrTimeout:
+		return "timed out"
+	case RespErrUnsupported:
+		return "unsupported"
+	case RespErrPermission:
+		return "permission denied"
+	default:
+		return fmt.Sprintf("error code %d", code)
+	}
+}
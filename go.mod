@@ -8,13 +8,11 @@ require (
 	github.com/johnietre/utils/go v0.0.0-20240514030306-cbc5817d8c89
 	github.com/joho/godotenv v1.5.1
 	github.com/spf13/cobra v1.8.0
+	github.com/spf13/pflag v1.0.5
 	golang.org/x/crypto v0.21.0
 	golang.org/x/net v0.22.0
+	golang.org/x/sys v0.18.0
 	golang.org/x/term v0.18.0
 )
 
-require (
-	github.com/inconshreveable/mousetrap v1.1.0 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/sys v0.18.0 // indirect
-)
+require github.com/inconshreveable/mousetrap v1.1.0 // indirect
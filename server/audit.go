@@ -0,0 +1,52 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/johnietre/gossh/common"
+)
+
+var (
+	auditLogPath string
+
+	auditMtx sync.Mutex
+	auditLog *json.Encoder
+)
+
+// auditEvent is an entry in the audit log, which is written as JSON lines.
+type auditEvent struct {
+	Time    time.Time          `json:"time"`
+	Event   string             `json:"event"`
+	User    string             `json:"user,omitempty"`
+	Session uint64             `json:"session,omitempty"`
+	Peer    string             `json:"peer,omitempty"`
+	Command []string           `json:"command,omitempty"`
+	Reason  string             `json:"reason,omitempty"`
+	Exit    *common.ExitStatus `json:"exit,omitempty"`
+}
+
+func openAuditLog(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	auditLog = json.NewEncoder(f)
+	return nil
+}
+
+// audit writes the event to the audit log, if there is one.
+func audit(ev auditEvent) {
+	if auditLog == nil {
+		return
+	}
+	ev.Time = time.Now()
+	auditMtx.Lock()
+	defer auditMtx.Unlock()
+	if err := auditLog.Encode(ev); err != nil {
+		log.Print("Error writing audit log: ", err)
+	}
+}
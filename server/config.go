@@ -0,0 +1,272 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/johnietre/gossh/common"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	configPath string
+	config     = &Config{}
+
+	// Compared against when the user doesn't exist so the response takes as
+	// long as for a wrong password
+	dummyHash []byte
+)
+
+// The name of the single user when no users are configured.
+const singleUserName = "gossh"
+
+// Config is the server config, loaded from a JSON file.
+type Config struct {
+	// Users maps usernames to users. If empty, the password set by the
+	// password environment variable is used and all clients are the same
+	// admin user (named singleUserName), regardless of the name they send.
+	Users map[string]*User `json:"users,omitempty"`
+	// Groups maps group names to groups, whose settings apply to the users in
+	// them.
+	Groups map[string]*Group `json:"groups,omitempty"`
+}
+
+// Group holds settings shared by the users in it.
+type Group struct {
+	SessionPolicy
+}
+
+// SessionPolicy limits how long SSH sessions can run. Limits not set for a
+// user fall back to those of their groups (the most restrictive being used)
+// and then the server's. A limit of "0s" means no limit.
+type SessionPolicy struct {
+	// IdleTimeout is how long a session can go without input before it's
+	// ended.
+	IdleTimeout *Duration `json:"idleTimeout,omitempty"`
+	// MaxDuration is how long a session can run before it's ended.
+	MaxDuration *Duration `json:"maxDuration,omitempty"`
+}
+
+type User struct {
+	Name string `json:"-"`
+	// PasswordHash is the bcrypt hash of the user's password.
+	PasswordHash string `json:"passwordHash"`
+	// Admin users can see and manage the sessions of all users.
+	Admin bool `json:"admin,omitempty"`
+	// RemoteForwardLimit is the max number of remote forwards the user can
+	// have at once. If 0, the server's limit is used. If negative, there is no
+	// limit.
+	RemoteForwardLimit int `json:"remoteForwardLimit,omitempty"`
+	// ForceCommand is the program and its args to run for all of the user's
+	// SSH sessions and exec commands instead of what was requested. The
+	// requested command is set in the GOSSH_ORIGINAL_COMMAND environment
+	// variable.
+	ForceCommand []string `json:"forceCommand,omitempty"`
+	// Allow is the services ("ssh", "procs", "files", "forward") the user can
+	// use. If empty, all are allowed, unless the user has a forced command, in
+	// which case only "ssh" is allowed.
+	Allow []string `json:"allow,omitempty"`
+	// Shell is the program and args used as the user's shell. If empty, the
+	// server's shell is used.
+	Shell []string `json:"shell,omitempty"`
+	// LoginShell is whether the user's shell is started as a login shell (with
+	// argv[0] prefixed with "-"), which is always the case if the server
+	// starts login shells.
+	LoginShell bool `json:"loginShell,omitempty"`
+	// Groups is the names of the groups the user is in.
+	Groups []string `json:"groups,omitempty"`
+	SessionPolicy
+}
+
+// serviceNames maps connection types to the service names used in
+// User.Allow.
+var serviceNames = map[byte]string{
+	common.TcpSsh:     "ssh",
+	common.TcpProcs:   "procs",
+	common.TcpFiles:   "files",
+	common.TcpForward: "forward",
+}
+
+func loadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c := &Config{}
+	if err := json.NewDecoder(f).Decode(c); err != nil {
+		return nil, fmt.Errorf("error parsing config: %w", err)
+	}
+	for name, group := range c.Groups {
+		if group == nil {
+			return nil, fmt.Errorf("missing config for group %q", name)
+		}
+	}
+	for name, user := range c.Users {
+		if user == nil {
+			return nil, fmt.Errorf("missing config for user %q", name)
+		}
+		user.Name = name
+		for _, g := range user.Groups {
+			if c.Groups[g] == nil {
+				return nil, fmt.Errorf("unknown group for user %q: %q", name, g)
+			}
+		}
+		for _, s := range user.Allow {
+			if !isServiceName(s) {
+				return nil, fmt.Errorf("invalid service for user %q: %q", name, s)
+			}
+		}
+	}
+	if len(c.Users) != 0 {
+		hash, err := bcrypt.GenerateFromPassword([]byte("gossh"), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, fmt.Errorf("error generating dummy hash: %w", err)
+		}
+		dummyHash = hash
+	}
+	return c, nil
+}
+
+// authenticate checks the username and password, returning the user if
+// successful.
+func authenticate(name string, pwd []byte) (*User, error) {
+	if len(config.Users) == 0 {
+		ok, err := checkPassword(pwd)
+		if err != nil {
+			return nil, common.ErrPasswordError.WithDetails(err.Error())
+		} else if !ok {
+			return nil, common.ErrPasswordInvalid
+		}
+		return &User{Name: singleUserName, Admin: true}, nil
+	}
+	user := config.Users[name]
+	if user == nil {
+		bcrypt.CompareHashAndPassword(dummyHash, pwd)
+		return nil, common.ErrPasswordInvalid
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), pwd)
+	if err == bcrypt.ErrMismatchedHashAndPassword || err == bcrypt.ErrHashTooShort {
+		return nil, common.ErrPasswordInvalid
+	} else if err != nil {
+		return nil, common.ErrPasswordError.WithDetails(err.Error())
+	}
+	return user, nil
+}
+
+// canManage returns whether the user can see and manage things owned by the
+// given owner.
+func (u *User) canManage(owner string) bool {
+	return u.Admin || u.Name == owner
+}
+
+// allows returns whether the user can use the service for the given
+// connection type. Unknown types are allowed so they can be rejected when
+// handled.
+func (u *User) allows(what byte) bool {
+	name, ok := serviceNames[what]
+	if !ok {
+		return true
+	}
+	allow := u.Allow
+	if len(allow) == 0 {
+		if len(u.ForceCommand) == 0 {
+			return true
+		}
+		allow = []string{"ssh"}
+	}
+	for _, s := range allow {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isServiceName(s string) bool {
+	for _, name := range serviceNames {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+func errServiceDenied(what byte) *common.Error {
+	return common.ErrPermission.WithDetails(
+		fmt.Sprintf("user not allowed to use %s", serviceNames[what]),
+	)
+}
+
+// shellArgs returns the program and args of the user's shell.
+func (u *User) shellArgs() []string {
+	if len(u.Shell) != 0 {
+		return u.Shell
+	}
+	return []string{shell}
+}
+
+// sessionPolicy returns the idle timeout and max duration of the user's SSH
+// sessions, 0 meaning no limit.
+func (u *User) sessionPolicy() (idle, maxDur time.Duration) {
+	idle, maxDur = idleTimeout, maxSessionDuration
+	if d, ok := u.policyLimit(func(p *SessionPolicy) *Duration {
+		return p.IdleTimeout
+	}); ok {
+		idle = d
+	}
+	if d, ok := u.policyLimit(func(p *SessionPolicy) *Duration {
+		return p.MaxDuration
+	}); ok {
+		maxDur = d
+	}
+	return
+}
+
+// policyLimit gets a limit from the user's policy, falling back to the most
+// restrictive of their groups' policies. Returns false if none set it.
+func (u *User) policyLimit(
+	get func(*SessionPolicy) *Duration,
+) (d time.Duration, ok bool) {
+	if l := get(&u.SessionPolicy); l != nil {
+		return time.Duration(*l), true
+	}
+	for _, name := range u.Groups {
+		g := config.Groups[name]
+		if g == nil {
+			continue
+		}
+		l := get(&g.SessionPolicy)
+		if l == nil {
+			continue
+		}
+		if gd := time.Duration(*l); !ok || d == 0 || (gd != 0 && gd < d) {
+			d, ok = gd, true
+		}
+	}
+	return
+}
+
+// Duration is a time.Duration that's (un)marshaled as a string (e.g., "30m").
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	} else if v < 0 {
+		return fmt.Errorf("negative duration: %s", s)
+	}
+	*d = Duration(v)
+	return nil
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/johnietre/gossh/common"
+)
+
+var (
+	// Patterns (see path.Match) of environment variables clients can set
+	acceptEnv []string
+	// Whether shells are started as login shells
+	loginShell bool
+)
+
+// newShellCmd creates the command for a new SSH session, running the
+// requested command or the shell.
+func newShellCmd(user *User, req common.SshReq) (*exec.Cmd, error) {
+	return newUserCmd(user, req.Command, req.Env, req.Dir, true)
+}
+
+// newUserCmd creates a command running the requested program and args, or
+// the shell if none were requested. If the user has a forced command, it's
+// run instead, with the requested command (if any) set in the
+// GOSSH_ORIGINAL_COMMAND environment variable.
+func newUserCmd(
+	user *User,
+	command []string,
+	reqEnv map[string]string,
+	dir string,
+	tty bool,
+) (*exec.Cmd, error) {
+	return newCmd(user, command, shellJoin(command), reqEnv, dir, tty)
+}
+
+// newCmd is like newUserCmd but with the original command, which is what's
+// set in GOSSH_ORIGINAL_COMMAND, given separately.
+func newCmd(
+	user *User,
+	command []string,
+	original string,
+	reqEnv map[string]string,
+	dir string,
+	tty bool,
+) (*exec.Cmd, error) {
+	args, isShell := command, false
+	if len(user.ForceCommand) != 0 {
+		args = user.ForceCommand
+	} else if len(args) == 0 {
+		args, isShell = user.shellArgs(), true
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	if isShell && (loginShell || user.LoginShell) {
+		// Login shells are signaled by a leading "-" in argv[0]
+		cmd.Args[0] = "-" + filepath.Base(args[0])
+	}
+	if err := setupCmd(cmd, user, reqEnv, dir, tty); err != nil {
+		return nil, err
+	}
+	if len(user.ForceCommand) != 0 && original != "" {
+		cmd.Env = append(cmd.Env, common.OriginalCommandEnvName+"="+original)
+		sort.Strings(cmd.Env)
+	}
+	return cmd, nil
+}
+
+// setupCmd sets the command's directory and environment. The environment is
+// the server's environment, the defaults (TERM, HOME, USER, SHELL, etc.), and
+// the client's accepted variables, in increasing order of precedence.
+func setupCmd(
+	cmd *exec.Cmd,
+	user *User,
+	reqEnv map[string]string,
+	dir string,
+	tty bool,
+) error {
+	cmd.Dir = sshDir
+	if dir != "" {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(sshDir, dir)
+		}
+		info, err := os.Stat(dir)
+		if err != nil {
+			return common.ErrorFrom(err)
+		} else if !info.IsDir() {
+			return common.NewError(
+				common.RespErrBadRequest, fmt.Sprintf("%s is not a directory", dir),
+			)
+		}
+		cmd.Dir = dir
+	}
+
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+	delete(env, common.PasswordEnvName)
+	delete(env, common.OriginalCommandEnvName)
+	for k, v := range defaultEnv(user, tty) {
+		env[k] = v
+	}
+	for k, v := range reqEnv {
+		if acceptedEnv(k) {
+			env[k] = v
+		}
+	}
+	cmd.Env = make([]string, 0, len(env))
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	sort.Strings(cmd.Env)
+	return nil
+}
+
+func defaultEnv(u *User, tty bool) map[string]string {
+	env := map[string]string{common.UserEnvName: u.Name}
+	if tty {
+		env["TERM"] = "xterm-256color"
+	}
+	sh := u.shellArgs()[0]
+	if p, err := exec.LookPath(sh); err == nil {
+		env["SHELL"] = p
+	} else {
+		env["SHELL"] = sh
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		env["HOME"] = home
+	}
+	if cu, err := user.Current(); err == nil {
+		env["USER"] = cu.Username
+		env["LOGNAME"] = cu.Username
+	}
+	return env
+}
+
+// acceptedEnv returns whether clients are allowed to set the given
+// environment variable.
+func acceptedEnv(name string) bool {
+	if name == "" || strings.ContainsAny(name, "=\x00") {
+		return false
+	} else if name == common.OriginalCommandEnvName {
+		// Only set by the server
+		return false
+	}
+	for _, pat := range acceptEnv {
+		if ok, _ := path.Match(pat, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// shellJoin joins the args into a string, quoting them as needed for a POSIX
+// shell.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+			strings.ContainsRune("_@%+=:,./-", r)) {
+			return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+		}
+	}
+	return s
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"log"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/johnietre/gossh/common"
+	utils "github.com/johnietre/utils/go"
+)
+
+// handleSshConnExec runs a command without a pty, sending its stdout and
+// stderr and receiving its stdin in exec frames.
+func handleSshConnExec(conn net.Conn, user *User) {
+	var req common.ExecReq
+	if err := common.ReadJsonFrame(conn, &req); err != nil {
+		common.WriteErrorMsg(conn, common.RespErrBadRequest, err.Error())
+		return
+	} else if len(req.Command) == 0 {
+		common.WriteErrorMsg(conn, common.RespErrBadRequest, "missing command")
+		return
+	}
+	cmd, err := newUserCmd(user, req.Command, req.Env, req.Dir, false)
+	if err != nil {
+		common.WriteError(conn, err)
+		return
+	}
+	setProcessGroup(cmd)
+	ec := &execConn{Conn: conn}
+	cmd.Stdout = ec.stream(common.ExecStdout)
+	cmd.Stderr = ec.stream(common.ExecStderr)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		common.WriteError(conn, err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		common.WriteError(conn, err)
+		return
+	}
+	if _, err := conn.Write([]byte{common.RespOk}); err != nil {
+		signalGroup(cmd.Process, syscall.SIGKILL)
+		cmd.Wait()
+		return
+	}
+	log.Printf("%s executing %q", user.Name, cmd.Args)
+
+	exited := make(chan utils.Unit)
+	// The process group isn't signaled once the process has been reaped since
+	// its ID may be reused
+	signal := func(sig syscall.Signal) {
+		select {
+		case <-exited:
+		default:
+			signalGroup(cmd.Process, sig)
+		}
+	}
+	go func() {
+		for {
+			typ, data, err := common.ReadExecFrame(conn)
+			if err != nil {
+				// The client is gone (or the connection was closed after the
+				// command exited)
+				signal(syscall.SIGKILL)
+				return
+			}
+			if typ == common.ExecSignal {
+				if len(data) == 1 {
+					signal(syscall.Signal(data[0]))
+				}
+				continue
+			} else if typ != common.ExecStdin {
+				continue
+			}
+			if len(data) == 0 {
+				stdin.Close()
+			} else if _, err := stdin.Write(data); err != nil {
+				// Discard the rest of the input
+				stdin.Close()
+			}
+		}
+	}()
+
+	cmd.Wait()
+	close(exited)
+	es := common.ExitStatusFromState(cmd.ProcessState)
+	ec.writeFrame(common.ExecExit, common.AppendExitStatus(nil, es))
+}
+
+// execConn writes exec frames to a connection.
+type execConn struct {
+	net.Conn
+	mtx sync.Mutex
+}
+
+func (ec *execConn) writeFrame(typ byte, data []byte) error {
+	ec.mtx.Lock()
+	defer ec.mtx.Unlock()
+	_, err := utils.WriteAll(ec.Conn, common.AppendExecFrame(nil, typ, data))
+	return err
+}
+
+func (ec *execConn) stream(typ byte) *execStream {
+	return &execStream{ec: ec, typ: typ}
+}
+
+// execStream writes data as exec frames of a given type.
+type execStream struct {
+	ec  *execConn
+	typ byte
+}
+
+func (es *execStream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n := len(p) - written
+		if n > common.MaxExecFrameLen {
+			n = common.MaxExecFrameLen
+		}
+		if err := es.ec.writeFrame(es.typ, p[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
 	"os"
@@ -23,6 +24,10 @@ func handleFilesConn(conn net.Conn) {
 	case common.HeaderRecvFiles:
 		handleFilesSendClientFiles(conn)
 	default:
+		common.WriteErrorMsg(
+			conn, common.RespErrBadRequest,
+			fmt.Sprintf("unknown files header: %d", buf[0]),
+		)
 		return
 	}
 
@@ -36,7 +41,7 @@ func handleFilesConn(conn net.Conn) {
 	// Check to make sure path exists
 	info, err := os.Stat(path)
 	if err != nil {
-		writeErr(conn, err)
+		common.WriteError(conn, err)
 		return
 	}
 	// Send file size
@@ -56,7 +61,8 @@ func handleFilesConn(conn net.Conn) {
 	// Open and send file
 	f, err := os.Open(path)
 	if err != nil {
-		writeErr(conn, err)
+		common.WriteError(conn, err)
+		return
 	}
 	defer f.Close()
 	if _, err := conn.Write([]byte{common.RespOk}); err != nil {
@@ -65,27 +71,6 @@ func handleFilesConn(conn net.Conn) {
 	io.CopyN(conn, f, int64(size))
 }
 
-func writeErr(w io.Writer, err error) error {
-	errCode, errMsg := byte(0), ""
-	if os.IsNotExist(err) {
-		errCode = common.RespErrNotExist
-	} else {
-		errCode, errMsg = common.RespErr, err.Error()
-	}
-	if len(errMsg) > 1<<16-1 {
-		errMsg = errMsg[:1<<16-1]
-	}
-	buf := append(
-		append(
-			[]byte{errCode},
-			binary.LittleEndian.AppendUint16(nil, uint16(len(errMsg)))...,
-		),
-		errMsg...,
-	)
-	_, err = w.Write(buf)
-	return err
-}
-
 func handleFilesRecvClientFiles(conn net.Conn) {
 	// Send response
 	if _, err := conn.Write([]byte{common.RespOk}); err != nil {
@@ -105,11 +90,7 @@ func handleFilesRecvClientFiles(conn net.Conn) {
 	// Make sure the path exists
 	f, err := os.OpenFile(target, os.O_RDONLY|os.O_CREATE, 0644)
 	if err != nil {
-		if os.IsNotExist(err) {
-			conn.Write([]byte{common.RespErrNotExist})
-		} else {
-			conn.Write(append([]byte{common.RespErrNotExist}, err.Error()...))
-		}
+		common.WriteError(conn, err)
 		return
 	}
 	f.Close()
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/johnietre/gossh/common"
+	utils "github.com/johnietre/utils/go"
+)
+
+var (
+	// Patterns (see path.Match) of host:port addresses clients can forward to
+	allowForward []string
+	// Patterns of host:port addresses clients can't forward to, even if allowed
+	denyForward []string
+	// Patterns of host:port addresses clients can have the server listen on
+	allowRemoteForward []string
+	remoteForwardLimit int
+
+	remoteForwardCounts   = make(map[string]int)
+	remoteForwardCountMtx sync.Mutex
+	// Connections accepted for remote forwards, waiting for the client to
+	// connect for them
+	pendingForwards = utils.NewSyncMap[uint64, *pendingForward]()
+)
+
+type pendingForward struct {
+	conn net.Conn
+	user string
+}
+
+func handleForwardConn(conn net.Conn, user *User) {
+	defer conn.Close()
+	var buf [1]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return
+	}
+	switch buf[0] {
+	case common.HeaderForwardDial:
+		handleForwardDial(conn, user)
+	case common.HeaderForwardListen:
+		handleForwardListen(conn, user)
+	case common.HeaderForwardAccept:
+		handleForwardAccept(conn, user)
+	default:
+		common.WriteErrorMsg(
+			conn, common.RespErrBadRequest,
+			fmt.Sprintf("unknown forward header: %d", buf[0]),
+		)
+	}
+}
+
+func handleForwardDial(conn net.Conn, user *User) {
+	var req common.ForwardReq
+	if err := common.ReadJsonFrame(conn, &req); err != nil {
+		common.WriteErrorMsg(conn, common.RespErrBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	dialAddr, err := resolveForward(ctx, req.Addr)
+	if err != nil {
+		if common.ErrorFrom(err).Code == common.RespErrPermission {
+			log.Printf("Denied %s forwarding to %s", user.Name, req.Addr)
+		}
+		common.WriteError(conn, err)
+		return
+	}
+	var dialer net.Dialer
+	target, err := dialer.DialContext(ctx, "tcp", dialAddr)
+	if err != nil {
+		code := common.RespErr
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			code = common.RespErrTimeout
+		}
+		common.WriteErrorMsg(conn, code, err.Error())
+		return
+	}
+	if _, err := conn.Write([]byte{common.RespOk}); err != nil {
+		target.Close()
+		return
+	}
+	log.Printf("%s forwarding %s to %s", user.Name, peerAddr(conn), req.Addr)
+	common.Pipe(conn, target)
+}
+
+// handleForwardListen listens on the requested address, notifying the client
+// of each accepted connection, until the client disconnects.
+func handleForwardListen(conn net.Conn, user *User) {
+	var req common.ForwardReq
+	if err := common.ReadJsonFrame(conn, &req); err != nil {
+		common.WriteErrorMsg(conn, common.RespErrBadRequest, err.Error())
+		return
+	}
+	if !matchAddr(allowRemoteForward, req.Addr) {
+		log.Printf("Denied %s listening on %s", user.Name, req.Addr)
+		common.WriteErrorMsg(
+			conn, common.RespErrPermission,
+			fmt.Sprintf("listening on %s is not allowed", req.Addr),
+		)
+		return
+	}
+	if limit, ok := acquireRemoteForward(user); !ok {
+		common.WriteErrorMsg(
+			conn, common.RespErrPermission,
+			fmt.Sprintf("too many remote forwards (limit %d)", limit),
+		)
+		return
+	}
+	defer releaseRemoteForward(user)
+	ln, err := net.Listen("tcp", req.Addr)
+	if err != nil {
+		common.WriteError(conn, err)
+		return
+	}
+	defer ln.Close()
+	resp := common.AppendStr16([]byte{common.RespOk}, ln.Addr().String())
+	if _, err := conn.Write(resp); err != nil {
+		return
+	}
+	log.Printf("%s listening on %s", user.Name, ln.Addr())
+	defer log.Printf("%s stopped listening on %s", user.Name, ln.Addr())
+
+	// Stop listening once the client disconnects
+	go func() {
+		io.Copy(io.Discard, conn)
+		ln.Close()
+	}()
+
+	var buf [9]byte
+	buf[0] = common.ActionForwardConn
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		id := idCounter.Add(1)
+		pendingForwards.Store(id, &pendingForward{conn: c, user: user.Name})
+		time.AfterFunc(time.Second*10, func() {
+			if pf, ok := pendingForwards.LoadAndDelete(id); ok {
+				pf.conn.Close()
+			}
+		})
+		binary.LittleEndian.PutUint64(buf[1:], id)
+		if _, err := conn.Write(buf[:]); err != nil {
+			return
+		}
+	}
+}
+
+// handleForwardAccept pairs the connection with a connection accepted for a
+// remote forward.
+func handleForwardAccept(conn net.Conn, user *User) {
+	var buf [8]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return
+	}
+	id := binary.LittleEndian.Uint64(buf[:])
+	pf, ok := pendingForwards.LoadAndDelete(id)
+	if !ok {
+		common.WriteErrorMsg(
+			conn, common.RespErrNotExist,
+			fmt.Sprintf("no pending connection with ID %d", id),
+		)
+		return
+	} else if pf.user != user.Name {
+		pf.conn.Close()
+		common.WriteErrorMsg(
+			conn, common.RespErrPermission,
+			fmt.Sprintf("connection %d belongs to another user", id),
+		)
+		return
+	}
+	if _, err := conn.Write([]byte{common.RespOk}); err != nil {
+		pf.conn.Close()
+		return
+	}
+	common.Pipe(conn, pf.conn)
+}
+
+// acquireRemoteForward reserves a remote forward for the user, returning the
+// user's limit and whether they are under it.
+func acquireRemoteForward(user *User) (int, bool) {
+	limit := remoteForwardLimit
+	if user.RemoteForwardLimit != 0 {
+		limit = user.RemoteForwardLimit
+	}
+	remoteForwardCountMtx.Lock()
+	defer remoteForwardCountMtx.Unlock()
+	if limit > 0 && remoteForwardCounts[user.Name] >= limit {
+		return limit, false
+	}
+	remoteForwardCounts[user.Name]++
+	return limit, true
+}
+
+func releaseRemoteForward(user *User) {
+	remoteForwardCountMtx.Lock()
+	defer remoteForwardCountMtx.Unlock()
+	if remoteForwardCounts[user.Name]--; remoteForwardCounts[user.Name] <= 0 {
+		delete(remoteForwardCounts, user.Name)
+	}
+}
+
+// resolveForward resolves the address to forward to, checking it and each of
+// the IPs its host resolves to against the allow and deny rules, and returns
+// the IP address to dial so the target can't change after it's checked.
+func resolveForward(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", common.NewError(common.RespErrBadRequest, err.Error())
+	}
+	portNum, err := net.DefaultResolver.LookupPort(ctx, "tcp", port)
+	if err != nil {
+		return "", common.NewError(common.RespErrBadRequest, err.Error())
+	}
+	port = strconv.Itoa(portNum)
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", common.NewError(common.RespErr, err.Error())
+	}
+	denied := common.NewError(
+		common.RespErrPermission,
+		fmt.Sprintf("forwarding to %s is not allowed", addr),
+	)
+	named := net.JoinHostPort(host, port)
+	if matchAddr(denyForward, addr) || matchAddr(denyForward, named) {
+		return "", denied
+	}
+	nameAllowed := matchAddr(allowForward, addr) || matchAddr(allowForward, named)
+	dialAddr := ""
+	for _, ip := range ips {
+		ipAddr := net.JoinHostPort(ip.String(), port)
+		if matchAddr(denyForward, ipAddr) {
+			return "", denied
+		} else if dialAddr == "" && (nameAllowed || matchAddr(allowForward, ipAddr)) {
+			dialAddr = ipAddr
+		}
+	}
+	if dialAddr == "" {
+		return "", denied
+	}
+	return dialAddr, nil
+}
+
+// matchAddr returns whether the host:port address matches any of the
+// patterns. Addresses are matched as given, without resolving hostnames (see
+// resolveForward).
+func matchAddr(pats []string, addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	for _, pat := range pats {
+		hostPat, portPat, err := net.SplitHostPort(pat)
+		if err != nil {
+			continue
+		}
+		hostOk, _ := path.Match(hostPat, host)
+		portOk, _ := path.Match(portPat, port)
+		if hostOk && portOk {
+			return true
+		}
+	}
+	return false
+}
+
+// checkForwardPatterns checks that the forwarding patterns are valid.
+func checkForwardPatterns(pats []string) error {
+	for _, pat := range pats {
+		host, port, err := net.SplitHostPort(pat)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pat, err)
+		}
+		if _, err := path.Match(host, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pat, err)
+		}
+		if _, err := path.Match(port, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pat, err)
+		}
+	}
+	return nil
+}
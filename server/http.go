@@ -1,13 +1,18 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	chi "github.com/go-chi/chi/v5"
 	"github.com/johnietre/gossh/common"
@@ -19,65 +24,176 @@ func runHttp(ln net.Listener) error {
 	if noProcs {
 		r.HandleFunc("/procs/", func(w http.ResponseWriter, r *http.Request) {
 			// FIXME: Status code
-			http.Error(w, "Server is not running procs", http.StatusNotFound)
+			httpError(
+				w, http.StatusNotFound,
+				common.ErrUnsupported.WithDetails("Server is not running procs"),
+			)
 		})
 		r.HandleFunc("/ws/procs/", func(w http.ResponseWriter, r *http.Request) {
 			// FIXME: Status code
-			http.Error(w, "Server is not running procs", http.StatusNotFound)
+			httpError(
+				w, http.StatusNotFound,
+				common.ErrUnsupported.WithDetails("Server is not running procs"),
+			)
 		})
 	} else {
 		r.Group(func(r chi.Router) {
-			r.Use(func(next http.Handler) http.Handler {
-				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					pwd := []byte(r.Header.Get(common.HttpPasswordHeader))
-					if ok, err := checkPassword(pwd); !ok {
-						http.Error(w, "password incorrect", http.StatusUnauthorized)
-					} else if err != nil {
-						log.Print("error checking password: ", err)
-						http.Error(
-							w,
-							"Error checking password",
-							http.StatusInternalServerError,
-						)
-					} else {
-						next.ServeHTTP(w, r)
-					}
-				})
-			})
+			r.Use(authMiddleware, requireService(common.TcpProcs))
 			r.Get("/procs/{id}", getProcHandler)
 			r.Get("/procs", getProcsHandler)
 			r.Post("/procs", addProcHandler)
+			r.Delete("/procs", purgeProcsHandler)
+			r.Delete("/procs/{id}", purgeProcsHandler)
 			r.Post("/procs/{id}/signal", signalProcHandler)
+			r.Get("/procs/{id}/wait", waitProcHandler)
+			r.Get("/procs/{id}/logs", procLogsHandler)
+			r.Get("/procs/{id}/logs/ws", procLogsWsHandler)
 		})
 		r.Handle("/ws/procs", webs.Handler(procsWsHandler))
 	}
 	if noSsh {
 		r.HandleFunc("/ws/ssh", func(w http.ResponseWriter, r *http.Request) {
 			// FIXME: Status code
-			http.Error(w, "Server is not running ssh", http.StatusNotFound)
+			httpError(
+				w, http.StatusNotFound,
+				common.ErrUnsupported.WithDetails("Server is not running ssh"),
+			)
 		})
 	} else {
+		r.Group(func(r chi.Router) {
+			r.Use(authMiddleware, requireService(common.TcpSsh))
+			r.Get("/sessions", getSessionsHandler)
+			r.Delete("/sessions/{id}", deleteSessionHandler)
+			r.Put("/sessions/{id}/shares/{user}", shareSessionHandler)
+			r.Delete("/sessions/{id}/shares/{user}", shareSessionHandler)
+			r.Get("/recordings", getRecordingsHandler)
+			r.Get("/recordings/{name}", getRecordingHandler)
+		})
 		r.Handle("/ws/ssh", webs.Handler(sshWsHandler))
+		if serveWeb {
+			r.Handle("/web/*", webHandler())
+			r.Get("/web", redirectWebHandler)
+			r.Get("/", redirectWebHandler)
+		}
 	}
+	r.Handle("/ws/forward", webs.Handler(forwardWsHandler))
+	r.Get("/banner", bannerHandler)
 
 	return http.Serve(ln, r)
 }
 
+type userCtxKey struct{}
+
+// authMiddleware authenticates the user using the user and password headers,
+// adding the user to the request context.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := authenticate(
+			r.Header.Get(common.HttpUserHeader),
+			[]byte(r.Header.Get(common.HttpPasswordHeader)),
+		)
+		if errors.Is(err, common.ErrPasswordError) {
+			log.Print("error checking password: ", err)
+			httpError(w, http.StatusInternalServerError, err)
+		} else if err != nil {
+			httpError(w, http.StatusUnauthorized, err)
+		} else {
+			ctx := context.WithValue(r.Context(), userCtxKey{}, user)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+	})
+}
+
+// requireService returns middleware, used after authMiddleware, checking that
+// the user can use the service for the given connection type.
+func requireService(what byte) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !reqUser(r).allows(what) {
+				httpError(w, http.StatusForbidden, errServiceDenied(what))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func reqUser(r *http.Request) *User {
+	return r.Context().Value(userCtxKey{}).(*User)
+}
+
+// bannerHandler sends the pre-auth banner, which is empty if there isn't one.
+func bannerHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(banner))
+}
+
+func redirectWebHandler(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/web/", http.StatusFound)
+}
+
 func sshWsHandler(ws *webs.Conn) {
-	handleSshConn(ws).Wait()
+	// Binary frames since the output isn't necessarily valid UTF-8, which
+	// browsers require of text frames.
+	ws.PayloadType = webs.BinaryFrame
+	user, ok := checkTcpPassword(ws, common.TcpSsh)
+	if !ok {
+		ws.Close()
+		return
+	}
+	handleSshConn(ws, user).Wait()
 	return
 }
 
+func forwardWsHandler(ws *webs.Conn) {
+	ws.PayloadType = webs.BinaryFrame
+	user, ok := checkTcpPassword(ws, common.TcpForward)
+	if !ok {
+		ws.Close()
+		return
+	}
+	handleForwardConn(ws, user)
+}
+
 func procsWsHandler(ws *webs.Conn) {
-	handleProcsConn(ws)
+	ws.PayloadType = webs.BinaryFrame
+	user, ok := checkTcpPassword(ws, common.TcpProcs)
+	if !ok {
+		ws.Close()
+		return
+	}
+	handleProcsConn(ws, user)
 	return
 }
 
+func getSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := json.NewEncoder(w).Encode(listSessions(reqUser(r))); err != nil {
+		// TODO
+	}
+}
+
+func deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	err := killSession(reqUser(r), common.KillSessionReq{
+		Session: idStr(r),
+		Reason:  r.URL.Query().Get("reason"),
+	})
+	if err != nil {
+		httpError(w, httpStatus(err), err)
+	}
+}
+
 func getProcsHandler(w http.ResponseWriter, r *http.Request) {
-	err := getAndSendProcs(func(procs common.Procs) error {
-		return json.NewEncoder(w).Encode(procs)
+	query := r.URL.Query()
+	list, err := listProcs(common.GetProcsReq{
+		Name:   query.Get("name"),
+		Status: query.Get("status"),
+		Env:    queryBool(query, "env"),
 	})
 	if err != nil {
+		httpError(w, httpStatus(err), err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(list); err != nil {
 		// TODO
 	}
 }
@@ -87,11 +203,12 @@ func getProcHandler(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		return
 	}
-	envVal := strings.ToLower(r.URL.Query().Get("env"))
-	getEnv := envVal == "1" || envVal == "true"
-	proc := getProc(id, getEnv)
+	proc := getProc(id, queryBool(r.URL.Query(), "env"))
 	if proc == nil {
-		http.Error(w, "no process with ID "+r.URL.Path, http.StatusNotFound)
+		httpError(
+			w, http.StatusNotFound,
+			common.NewError(common.RespErrNotExist, "no process with ID "+idStr(r)),
+		)
 		return
 	}
 	if err := json.NewEncoder(w).Encode(proc); err != nil {
@@ -102,12 +219,14 @@ func getProcHandler(w http.ResponseWriter, r *http.Request) {
 func addProcHandler(w http.ResponseWriter, r *http.Request) {
 	proc := &common.Process{}
 	if err := json.NewDecoder(r.Body).Decode(proc); err != nil {
-		// TODO
-		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		httpError(
+			w, http.StatusBadRequest,
+			common.NewError(common.RespErrBadRequest, err.Error()),
+		)
 		return
 	}
 	if err := addProc(proc); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, httpStatus(err), err)
 		return
 	}
 	if err := json.NewEncoder(w).Encode(proc); err != nil {
@@ -115,6 +234,27 @@ func addProcHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// purgeProcsHandler removes the exited process with the ID, or all exited
+// processes if there's no ID, from the history.
+func purgeProcsHandler(w http.ResponseWriter, r *http.Request) {
+	var req common.PurgeProcsReq
+	if idStr(r) != "" {
+		id, ok := getId(w, r)
+		if !ok {
+			return
+		}
+		req.Ids = []uint64{id}
+	}
+	purged, err := purgeProcs(req)
+	if err != nil {
+		httpError(w, httpStatus(err), err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(purged); err != nil {
+		// TODO
+	}
+}
+
 func signalProcHandler(w http.ResponseWriter, r *http.Request) {
 	id, ok := getId(w, r)
 	if !ok {
@@ -123,20 +263,236 @@ func signalProcHandler(w http.ResponseWriter, r *http.Request) {
 	signalStr := r.URL.Query().Get("signal")
 	signalInt, err := strconv.Atoi(signalStr)
 	if err != nil {
+		httpError(
+			w, http.StatusBadRequest,
+			common.NewError(common.RespErrBadRequest, "invalid signal"),
+		)
 		return
 	}
 	signal := syscall.Signal(signalInt)
 	if err := signalProc(id, signal); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, httpStatus(err), err)
+	}
+}
+
+func waitProcHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := getId(w, r)
+	if !ok {
+		return
+	}
+	es, err := waitProc(id, r.Context().Done())
+	if err != nil {
+		httpError(w, httpStatus(err), err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(es); err != nil {
+		// TODO
 	}
 }
 
+// procLogsHandler streams the process's output as newline-delimited JSON, or
+// as server-sent events if the client accepts them.
+func procLogsHandler(w http.ResponseWriter, r *http.Request) {
+	req, pl, ok := getProcLogsReq(w, r)
+	if !ok {
+		return
+	}
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if lastId := r.Header.Get("Last-Event-ID"); sse && lastId != "" {
+		// Resume after the last line the reconnecting client received
+		if seq, err := strconv.ParseUint(lastId, 10, 64); err == nil {
+			req.After = &seq
+		}
+	}
+
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	pl.stream(req, r.Context().Done(), func(line common.ProcLogLine) error {
+		b, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+		if sse {
+			_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", line.Seq, b)
+		} else {
+			_, err = w.Write(append(b, '\n'))
+		}
+		if err == nil && flusher != nil {
+			flusher.Flush()
+		}
+		return err
+	})
+}
+
+// procLogsWsHandler streams the process's output over a websocket, each line
+// as a JSON text message.
+func procLogsWsHandler(w http.ResponseWriter, r *http.Request) {
+	req, pl, ok := getProcLogsReq(w, r)
+	if !ok {
+		return
+	}
+	webs.Handler(func(ws *webs.Conn) {
+		defer ws.Close()
+		pl.stream(req, connGone(ws), func(line common.ProcLogLine) error {
+			return webs.JSON.Send(ws, line)
+		})
+	}).ServeHTTP(w, r)
+}
+
+// getProcLogsReq gets the logs request from the URL and the process's log,
+// writing an error if either can't be gotten.
+func getProcLogsReq(
+	w http.ResponseWriter,
+	r *http.Request,
+) (common.ProcLogsReq, *procLog, bool) {
+	id, ok := getId(w, r)
+	if !ok {
+		return common.ProcLogsReq{}, nil, false
+	}
+	query := r.URL.Query()
+	req := common.ProcLogsReq{Id: id, Follow: queryBool(query, "follow")}
+	if tailStr := query.Get("tail"); tailStr != "" {
+		tail, err := strconv.Atoi(tailStr)
+		if err != nil || tail < 0 {
+			httpError(
+				w, http.StatusBadRequest,
+				common.NewError(common.RespErrBadRequest, "invalid tail"),
+			)
+			return req, nil, false
+		}
+		req.Tail = tail
+	}
+	if sinceStr := query.Get("since"); sinceStr != "" {
+		since, err := common.ParseSince(sinceStr, time.Now())
+		if err != nil {
+			httpError(
+				w, http.StatusBadRequest,
+				common.NewError(common.RespErrBadRequest, err.Error()),
+			)
+			return req, nil, false
+		}
+		req.Since = since
+	}
+	pl, err := findProcLog(id)
+	if err != nil {
+		httpError(w, httpStatus(err), err)
+		return req, nil, false
+	}
+	return req, pl, true
+}
+
+func shareSessionHandler(w http.ResponseWriter, r *http.Request) {
+	err := shareSession(reqUser(r), common.ShareSessionReq{
+		Session: idStr(r),
+		User:    chi.URLParam(r, "user"),
+		Write:   queryBool(r.URL.Query(), "write"),
+		Remove:  r.Method == http.MethodDelete,
+	})
+	if err != nil {
+		httpError(w, httpStatus(err), err)
+	}
+}
+
+func getRecordingsHandler(w http.ResponseWriter, r *http.Request) {
+	if recordDir == "" {
+		httpError(
+			w, http.StatusNotImplemented,
+			common.ErrUnsupported.WithDetails("Server is not recording sessions"),
+		)
+		return
+	}
+	recs, err := listRecordings(reqUser(r))
+	if err != nil {
+		httpError(w, httpStatus(err), err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(recs); err != nil {
+		// TODO
+	}
+}
+
+func getRecordingHandler(w http.ResponseWriter, r *http.Request) {
+	if recordDir == "" {
+		httpError(
+			w, http.StatusNotImplemented,
+			common.ErrUnsupported.WithDetails("Server is not recording sessions"),
+		)
+		return
+	}
+	name := chi.URLParam(r, "name")
+	f, err := openRecording(reqUser(r), name)
+	if err != nil {
+		httpError(w, httpStatus(err), err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set(
+		"Content-Disposition", fmt.Sprintf("attachment; filename=%q", name),
+	)
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
 func getId(w http.ResponseWriter, r *http.Request) (uint64, bool) {
-	idStr := chi.URLParam(r, "id")
-	id, err := strconv.ParseUint(idStr, 10, 64)
+	id, err := strconv.ParseUint(idStr(r), 10, 64)
 	if err != nil {
-		http.Error(w, "invalid ID", http.StatusBadRequest)
+		httpError(
+			w, http.StatusBadRequest,
+			common.NewError(common.RespErrBadRequest, "invalid ID"),
+		)
 		return 0, false
 	}
 	return id, true
 }
+
+func idStr(r *http.Request) string {
+	return chi.URLParam(r, "id")
+}
+
+// queryBool returns whether the query parameter is "1" or "true".
+func queryBool(query url.Values, name string) bool {
+	val := strings.ToLower(query.Get(name))
+	return val == "1" || val == "true"
+}
+
+// httpStatus returns the HTTP status code corresponding to the error.
+func httpStatus(err error) int {
+	switch common.ErrorFrom(err).Code {
+	case common.RespErrNotExist:
+		return http.StatusNotFound
+	case common.RespErrBadRequest:
+		return http.StatusBadRequest
+	case common.RespErrPasswordInvalid:
+		return http.StatusUnauthorized
+	case common.RespErrPermission:
+		return http.StatusForbidden
+	case common.RespErrTimeout:
+		return http.StatusGatewayTimeout
+	case common.RespErrUnsupported:
+		return http.StatusNotImplemented
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// httpError writes the error as JSON with the given status code.
+func httpError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(common.ErrorFrom(err))
+}
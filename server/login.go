@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/johnietre/gossh/common"
+)
+
+var (
+	bannerPath, motdPath string
+	// The pre-auth banner shown by clients before logging in
+	banner string
+	motd   *template.Template
+
+	// Maps usernames to their last logins since the server started
+	lastLogins    = make(map[string]*lastLogin)
+	lastLoginsMtx sync.Mutex
+)
+
+type lastLogin struct {
+	Time time.Time
+	Peer string
+}
+
+// motdData is what the MOTD template is rendered with.
+type motdData struct {
+	User     string
+	Hostname string
+	Time     time.Time
+	// The user's previous login, if any
+	LastLogin *lastLogin
+	// The number of running gossh procs
+	Procs int
+	// The number of the user's running SSH sessions, including the new one
+	Sessions int
+}
+
+// loadLoginFiles loads the banner and MOTD template, if set.
+func loadLoginFiles() error {
+	if bannerPath != "" {
+		b, err := os.ReadFile(bannerPath)
+		if err != nil {
+			return fmt.Errorf("error reading banner: %w", err)
+		}
+		banner = string(b)
+	}
+	if motdPath != "" {
+		t, err := template.ParseFiles(motdPath)
+		if err != nil {
+			return fmt.Errorf("error parsing MOTD: %w", err)
+		}
+		motd = t
+	}
+	return nil
+}
+
+// recordLogin records the user's login for a new shell session, returning the
+// rendered MOTD (with newlines converted for a terminal), if there is one.
+func recordLogin(user *User, peer string) []byte {
+	now := time.Now()
+	lastLoginsMtx.Lock()
+	prev := lastLogins[user.Name]
+	lastLogins[user.Name] = &lastLogin{Time: now, Peer: peer}
+	lastLoginsMtx.Unlock()
+	if motd == nil {
+		return nil
+	}
+	data := motdData{
+		User:      user.Name,
+		Time:      now,
+		LastLogin: prev,
+		Sessions:  1,
+	}
+	data.Hostname, _ = os.Hostname()
+	procs.RApply(func(pp *common.Procs) {
+		for _, p := range *pp {
+			if p.Status() == common.ProcRunning {
+				data.Procs++
+			}
+		}
+	})
+	sessions.Range(func(_ uint64, s *sshSession) bool {
+		if s.user == user.Name {
+			data.Sessions++
+		}
+		return true
+	})
+	var buf bytes.Buffer
+	if err := motd.Execute(&buf, data); err != nil {
+		log.Print("Error rendering MOTD: ", err)
+		return nil
+	}
+	s := strings.ReplaceAll(buf.String(), "\r\n", "\n")
+	return []byte(strings.ReplaceAll(s, "\n", "\r\n"))
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	// Server-wide defaults for session policies, 0 meaning no limit
+	idleTimeout, maxSessionDuration time.Duration
+	// How long before a session is ended by a policy to warn its clients
+	sessionWarning time.Duration
+)
+
+// enforcePolicy ends the session once it has gone idle (without input) for
+// idle or has run for maxDur, warning the clients beforehand. Limits of 0 are
+// ignored.
+func (s *sshSession) enforcePolicy(idle, maxDur time.Duration) {
+	var warned time.Time
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-s.done:
+			return
+		}
+		deadline, limit := s.policyDeadline(idle, maxDur)
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			reason := limit + " reached"
+			log.Printf("Session %d: %s", s.id, reason)
+			s.kill(reason)
+			return
+		}
+		if sessionWarning > 0 && wait <= sessionWarning {
+			if !warned.Equal(deadline) {
+				warned = deadline
+				s.warn(wait, limit)
+			}
+		} else if sessionWarning > 0 {
+			// Wake up to warn
+			wait -= sessionWarning
+		}
+		timer.Reset(wait)
+	}
+}
+
+// policyDeadline returns when the session will be ended and a description of
+// the limit which will end it.
+func (s *sshSession) policyDeadline(
+	idle, maxDur time.Duration,
+) (deadline time.Time, limit string) {
+	if idle > 0 {
+		deadline = time.Unix(0, s.lastInput.Load()).Add(idle)
+		limit = fmt.Sprintf("idle timeout of %v", idle)
+	}
+	if maxDur > 0 {
+		if d := s.started.Add(maxDur); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+			limit = fmt.Sprintf("max session duration of %v", maxDur)
+		}
+	}
+	return
+}
+
+// warn writes a banner into the session's output saying it will be ended.
+func (s *sshSession) warn(wait time.Duration, limit string) {
+	wait = wait.Round(time.Second)
+	audit(auditEvent{
+		Event:   "session-warning",
+		User:    s.user,
+		Session: s.id,
+		Reason:  fmt.Sprintf("ending in %v: %s", wait, limit),
+	})
+	s.broadcast([]byte(fmt.Sprintf(
+		"\r\n*** gossh: this session will be ended in %v (%s) ***\r\n",
+		wait, limit,
+	)))
+}
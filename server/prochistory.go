@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/johnietre/gossh/common"
+)
+
+var (
+	// Max number of exited processes kept, negative meaning no limit
+	procHistoryMax int
+	// How long exited processes are kept, 0 meaning until procHistoryMax is hit
+	procHistoryRetention time.Duration
+)
+
+// Number of lines of output kept with an exited process.
+const procHistoryOutputLines = 10
+
+// recordExit is called once the process has exited to keep the end of its
+// output and prune the history. Only the lines of output in memory are kept
+// with the history, so any spill file is removed.
+func recordExit(proc *common.Process, pl *procLog) {
+	if pl != nil {
+		pl.close()
+		output := pl.last(procHistoryOutputLines)
+		procs.Apply(func(*common.Procs) {
+			proc.Output = output
+		})
+		pl.removeSpill()
+	}
+	pruneProcHistory()
+}
+
+// runPruneProcHistory prunes the process history every minute.
+func runPruneProcHistory() {
+	for {
+		time.Sleep(time.Minute)
+		pruneProcHistory()
+	}
+}
+
+// pruneProcHistory removes the exited processes older than the retention
+// period and the oldest beyond the max number kept.
+func pruneProcHistory() {
+	var removed []uint64
+	procs.Apply(func(pp *common.Procs) {
+		var exited []*common.Process
+		for _, p := range *pp {
+			if p.Status() == common.ProcExited {
+				exited = append(exited, p)
+			}
+		}
+		// Newest first
+		sort.Slice(exited, func(i, j int) bool {
+			return exited[i].End > exited[j].End
+		})
+		prune := make(map[uint64]bool)
+		for i, p := range exited {
+			old := procHistoryRetention > 0 &&
+				time.Since(time.Unix(p.End, 0)) > procHistoryRetention
+			if old || (procHistoryMax >= 0 && i >= procHistoryMax) {
+				prune[p.Id] = true
+			}
+		}
+		removed = removeProcsLocked(pp, func(p *common.Process) bool {
+			return prune[p.Id]
+		})
+	})
+	discardProcLogs(removed)
+}
+
+// purgeProcs removes the exited processes with the given IDs, or all exited
+// processes if none are given, returning the IDs of those removed.
+func purgeProcs(req common.PurgeProcsReq) (purged []uint64, err error) {
+	procs.Apply(func(pp *common.Procs) {
+		// Check them all first so nothing is removed if any can't be
+		ids := make(map[uint64]bool, len(req.Ids))
+		for _, id := range req.Ids {
+			if p := findProcLocked(*pp, id); p == nil {
+				err = errNoProc(id)
+				return
+			} else if p.Status() != common.ProcExited {
+				err = common.NewError(
+					common.RespErrBadRequest,
+					fmt.Sprintf("process %d is still running", id),
+				)
+				return
+			}
+			ids[id] = true
+		}
+		purged = removeProcsLocked(pp, func(p *common.Process) bool {
+			return p.Status() == common.ProcExited && (len(ids) == 0 || ids[p.Id])
+		})
+	})
+	discardProcLogs(purged)
+	return
+}
+
+// removeProcsLocked removes the processes for which remove returns true,
+// returning their IDs. Must be called with the procs lock held.
+func removeProcsLocked(
+	pp *common.Procs,
+	remove func(*common.Process) bool,
+) []uint64 {
+	removed := []uint64{}
+	kept := (*pp)[:0]
+	for _, p := range *pp {
+		if remove(p) {
+			removed = append(removed, p.Id)
+		} else {
+			kept = append(kept, p)
+		}
+	}
+	for i := len(kept); i < len(*pp); i++ {
+		(*pp)[i] = nil
+	}
+	*pp = kept
+	return removed
+}
+
+// discardProcLogs discards the logs of the removed processes.
+func discardProcLogs(ids []uint64) {
+	for _, id := range ids {
+		if pl, ok := procLogs.LoadAndDelete(id); ok {
+			pl.discard()
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/johnietre/gossh/common"
+	utils "github.com/johnietre/utils/go"
+)
+
+var (
+	procLogs = utils.NewSyncMap[uint64, *procLog]()
+
+	// Number of lines of output kept in memory per process
+	procLogLines int
+	// Whether lines dropped from memory are kept in a file in procsLogDir
+	procLogSpill bool
+)
+
+const (
+	// Lines longer than this are split.
+	maxProcLogLine = 1 << 14
+	// How long to keep reading output after the process exits, in case its
+	// children still have the output open.
+	procLogDrainTimeout = time.Second
+)
+
+// procLog holds the last lines of a process's output. Lines dropped from
+// memory are appended to the spill file, if there is one, so the two together
+// hold all of the output while the process runs.
+type procLog struct {
+	id uint64
+
+	mtx sync.Mutex
+	// Ring of the lines in memory, the oldest at start
+	lines []common.ProcLogLine
+	start int
+	// The sequence number of the next line
+	next  uint64
+	spill *os.File
+	// Closed and replaced whenever a line is added or the log is closed
+	changed chan utils.Unit
+	closed  bool
+
+	// Set before the process is started
+	writers []*procLogWriter
+	// The ends of the output pipes given to the process and read by the
+	// server
+	pipeWriters, pipeReaders []*os.File
+	readers                  sync.WaitGroup
+	closeWritersOnce         sync.Once
+	drainOnce                sync.Once
+}
+
+func newProcLog(proc *common.Process) (*procLog, error) {
+	pl := &procLog{
+		id:      proc.Id,
+		lines:   make([]common.ProcLogLine, 0, procLogLines),
+		changed: make(chan utils.Unit),
+	}
+	if procLogSpill {
+		name := fmt.Sprintf(
+			"%s-%d.lines", time.Now().Format("20060102-150405"), proc.Id,
+		)
+		f, err := os.OpenFile(
+			filepath.Join(procsLogDir, name),
+			os.O_RDWR|os.O_CREATE|os.O_TRUNC,
+			0600,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error creating log spill file: %w", err)
+		}
+		pl.spill = f
+	}
+	return pl, nil
+}
+
+// capture gives the command pipes for its stdout and stderr, which the server
+// reads to write the output to the log as well as wherever it was going.
+// Errors writing to the original destination are ignored so the process isn't
+// affected by them. If stderr is sent to stdout, both share a pipe to keep
+// their order, so all lines are labeled stdout. closeWriters must be called
+// once the process is started.
+func (pl *procLog) capture(cmd *exec.Cmd) error {
+	merged := cmd.Stdout != nil && cmd.Stderr == cmd.Stdout
+	stdout, err := pl.pipe(cmd.Stdout, "stdout")
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = stdout
+	if merged {
+		cmd.Stderr = stdout
+		return nil
+	}
+	cmd.Stderr, err = pl.pipe(cmd.Stderr, "stderr")
+	return err
+}
+
+func (pl *procLog) pipe(dst io.Writer, stream string) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("error creating output pipe: %w", err)
+	}
+	lw := &procLogWriter{pl: pl, stream: stream, dst: dst}
+	pl.writers = append(pl.writers, lw)
+	pl.pipeReaders = append(pl.pipeReaders, r)
+	pl.pipeWriters = append(pl.pipeWriters, w)
+	pl.readers.Add(1)
+	go pl.read(r, lw)
+	return w, nil
+}
+
+// closeWriters closes the server's copies of the ends of the pipes the
+// process writes to, so reading stops once the process's are closed.
+func (pl *procLog) closeWriters() {
+	pl.closeWritersOnce.Do(func() {
+		for _, w := range pl.pipeWriters {
+			w.Close()
+		}
+	})
+}
+
+func (pl *procLog) read(r *os.File, lw *procLogWriter) {
+	defer pl.readers.Done()
+	buf := make([]byte, 1<<15)
+	for {
+		n, err := r.Read(buf)
+		if n != 0 {
+			if lw.dst != nil {
+				lw.dst.Write(buf[:n])
+			}
+			lw.Write(buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// drain waits for the rest of the output once the process has exited, giving
+// up after procLogDrainTimeout if it's still held open (e.g., by a daemon the
+// process started).
+func (pl *procLog) drain() {
+	pl.drainOnce.Do(func() {
+		pl.closeWriters()
+		done := make(chan utils.Unit)
+		go func() {
+			pl.readers.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(procLogDrainTimeout):
+		}
+		for _, r := range pl.pipeReaders {
+			r.Close()
+		}
+		<-done
+	})
+}
+
+func (pl *procLog) add(stream, text string) {
+	pl.mtx.Lock()
+	defer pl.mtx.Unlock()
+	line := common.ProcLogLine{
+		Seq:    pl.next,
+		Time:   time.Now(),
+		Stream: stream,
+		Text:   text,
+	}
+	pl.next++
+	if len(pl.lines) < procLogLines {
+		pl.lines = append(pl.lines, line)
+	} else if len(pl.lines) != 0 {
+		if pl.spill != nil {
+			pl.spillLocked(pl.lines[pl.start])
+		}
+		pl.lines[pl.start] = line
+		pl.start = (pl.start + 1) % len(pl.lines)
+	}
+	close(pl.changed)
+	pl.changed = make(chan utils.Unit)
+}
+
+func (pl *procLog) spillLocked(line common.ProcLogLine) {
+	b, err := json.Marshal(line)
+	if err == nil {
+		_, err = pl.spill.Write(append(b, '\n'))
+	}
+	if err != nil {
+		log.Printf("Error writing log spill file of proc %d: %v", pl.id, err)
+		pl.spill.Close()
+		pl.spill = nil
+	}
+}
+
+// since returns the lines starting with the given sequence number, a channel
+// closed once there are more lines, and whether no more lines will be added.
+func (pl *procLog) since(seq uint64) ([]common.ProcLogLine, <-chan utils.Unit, bool) {
+	pl.mtx.Lock()
+	defer pl.mtx.Unlock()
+	var lines []common.ProcLogLine
+	if first := pl.next - uint64(len(pl.lines)); seq < first && pl.spill != nil {
+		lines = pl.readSpillLocked(seq)
+	}
+	for i := range pl.lines {
+		line := pl.lines[(pl.start+i)%len(pl.lines)]
+		if line.Seq >= seq {
+			lines = append(lines, line)
+		}
+	}
+	return lines, pl.changed, pl.closed
+}
+
+// last returns up to the last n lines in memory.
+func (pl *procLog) last(n int) []common.ProcLogLine {
+	pl.mtx.Lock()
+	defer pl.mtx.Unlock()
+	if n > len(pl.lines) {
+		n = len(pl.lines)
+	}
+	lines := make([]common.ProcLogLine, 0, n)
+	for i := len(pl.lines) - n; i < len(pl.lines); i++ {
+		lines = append(lines, pl.lines[(pl.start+i)%len(pl.lines)])
+	}
+	return lines
+}
+
+// readSpillLocked reads the lines in the spill file starting with the given
+// sequence number.
+func (pl *procLog) readSpillLocked(seq uint64) (lines []common.ProcLogLine) {
+	f, err := os.Open(pl.spill.Name())
+	if err != nil {
+		log.Printf("Error reading log spill file of proc %d: %v", pl.id, err)
+		return nil
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	for {
+		var line common.ProcLogLine
+		if err := dec.Decode(&line); err != nil {
+			return
+		} else if line.Seq >= seq {
+			lines = append(lines, line)
+		}
+	}
+}
+
+// firstSeq returns the sequence number of the first line matching the
+// request, ignoring Follow.
+func (pl *procLog) firstSeq(req common.ProcLogsReq) uint64 {
+	if req.After != nil {
+		return *req.After + 1
+	}
+	pl.mtx.Lock()
+	inMem := uint64(len(pl.lines))
+	next := pl.next
+	pl.mtx.Unlock()
+	if req.Since.IsZero() {
+		if req.Tail <= 0 || uint64(req.Tail) >= next {
+			return 0
+		} else if uint64(req.Tail) <= inMem {
+			return next - uint64(req.Tail)
+		}
+	}
+	lines, _, _ := pl.since(0)
+	i := len(lines)
+	for i > 0 && !lines[i-1].Time.Before(req.Since) {
+		i--
+	}
+	if req.Tail > 0 && len(lines)-i > req.Tail {
+		i = len(lines) - req.Tail
+	}
+	if i == len(lines) {
+		return next
+	}
+	return lines[i].Seq
+}
+
+// close drains the output, adds any partial lines, and marks the log as done,
+// waking any followers. Must only be called once the process has exited (or
+// failed to start).
+func (pl *procLog) close() {
+	pl.drain()
+	for _, w := range pl.writers {
+		if len(w.partial) != 0 {
+			w.flush()
+		}
+	}
+	pl.mtx.Lock()
+	defer pl.mtx.Unlock()
+	if pl.closed {
+		return
+	}
+	pl.closed = true
+	close(pl.changed)
+	pl.changed = make(chan utils.Unit)
+}
+
+// discard closes the log and removes any spill file.
+func (pl *procLog) discard() {
+	pl.close()
+	pl.removeSpill()
+}
+
+// removeSpill removes the spill file, if any, leaving only the lines in
+// memory.
+func (pl *procLog) removeSpill() {
+	pl.mtx.Lock()
+	defer pl.mtx.Unlock()
+	if pl.spill != nil {
+		pl.spill.Close()
+		os.Remove(pl.spill.Name())
+		pl.spill = nil
+	}
+}
+
+// findProcLog returns the log of the process with the given ID.
+func findProcLog(id uint64) (*procLog, error) {
+	if pl, ok := procLogs.Load(id); ok {
+		return pl, nil
+	} else if getProc(id, false) == nil {
+		return nil, errNoProc(id)
+	}
+	return nil, common.NewError(
+		common.RespErrUnsupported,
+		fmt.Sprintf("output of process %d isn't captured", id),
+	)
+}
+
+// stream sends the lines matching the request until there are no more (and
+// the process has exited, if following) or cancel is closed.
+func (pl *procLog) stream(
+	req common.ProcLogsReq,
+	cancel <-chan struct{},
+	send func(common.ProcLogLine) error,
+) error {
+	seq := pl.firstSeq(req)
+	for {
+		lines, changed, closed := pl.since(seq)
+		for _, line := range lines {
+			if err := send(line); err != nil {
+				return err
+			}
+			seq = line.Seq + 1
+		}
+		if !req.Follow || (closed && len(lines) == 0) {
+			return nil
+		} else if len(lines) != 0 {
+			// Check for lines added while sending
+			continue
+		}
+		select {
+		case <-changed:
+		case <-cancel:
+			return nil
+		}
+	}
+}
+
+// procLogWriter splits the output written into lines for the log.
+type procLogWriter struct {
+	pl     *procLog
+	stream string
+	// Where the output was going, if anywhere
+	dst     io.Writer
+	partial []byte
+}
+
+func (w *procLogWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) != 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i == -1 {
+			w.partial = append(w.partial, p...)
+			if len(w.partial) >= maxProcLogLine {
+				w.flush()
+			}
+			break
+		}
+		w.partial = append(w.partial, p[:i]...)
+		p = p[i+1:]
+		w.flush()
+	}
+	return n, nil
+}
+
+// flush adds the partial line, split if it's too long.
+func (w *procLogWriter) flush() {
+	text := bytes.TrimSuffix(w.partial, []byte{'\r'})
+	for len(text) > maxProcLogLine {
+		w.pl.add(w.stream, string(text[:maxProcLogLine]))
+		text = text[maxProcLogLine:]
+	}
+	w.pl.add(w.stream, string(text))
+	w.partial = w.partial[:0]
+}
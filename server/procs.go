@@ -3,8 +3,11 @@ package server
 import (
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net"
+	"os/exec"
+	"path"
 	"sync/atomic"
 	"syscall"
 
@@ -15,6 +18,9 @@ import (
 var (
 	procs  = utils.NewRWMutex[common.Procs](common.Procs{})
 	procId atomic.Uint64
+
+	// Directory for the log files of procs logging to common.ProcLog
+	procsLogDir string
 )
 
 func nextProcId(procs []*common.Process) uint64 {
@@ -36,50 +42,167 @@ func nextProcId(procs []*common.Process) uint64 {
 	}
 }
 
+// getProc returns a copy of the process with the given ID, or nil.
 func getProc(id uint64, getEnv bool) (proc *common.Process) {
+	procs.RApply(func(pp *common.Procs) {
+		if p := findProcLocked(*pp, id); p != nil {
+			proc = copyProc(p, getEnv)
+		}
+	})
+	return
+}
+
+// findProcLocked returns the process with the given ID, or nil. Must be called
+// with the procs lock held.
+func findProcLocked(list common.Procs, id uint64) *common.Process {
+	for _, p := range list {
+		if p.Id == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// listProcs returns the processes matching the request.
+func listProcs(req common.GetProcsReq) (common.Procs, error) {
+	if req.Status != "" &&
+		req.Status != common.ProcRunning && req.Status != common.ProcExited {
+		return nil, common.NewError(
+			common.RespErrBadRequest,
+			fmt.Sprintf("invalid status %q", req.Status),
+		)
+	} else if _, err := path.Match(req.Name, ""); err != nil {
+		return nil, common.NewError(
+			common.RespErrBadRequest,
+			fmt.Sprintf("invalid name pattern %q", req.Name),
+		)
+	}
+	list := common.Procs{}
 	procs.RApply(func(pp *common.Procs) {
 		for _, p := range *pp {
-			if p.Id == id {
-				if getEnv {
-					p.Env = p.CmdEnv()
+			if req.Status != "" && p.Status() != req.Status {
+				continue
+			} else if req.Name != "" {
+				if ok, _ := path.Match(req.Name, p.Name); !ok {
+					continue
 				}
-				proc = p
-				return
 			}
+			list = append(list, copyProc(p, req.Env))
 		}
 	})
-	return
+	return list, nil
 }
 
-func getAndSendProcs(f func(common.Procs) error) error {
-	pp := procs.RLock()
-	defer procs.RUnlock()
-	return f(*pp)
+// copyProc returns a copy of the process so it can be used without the lock
+// held, optionally with its environment set (the original is left without it
+// so it isn't always sent).
+func copyProc(p *common.Process, getEnv bool) *common.Process {
+	cp := *p
+	if getEnv {
+		cp.Env = p.CmdEnv()
+	}
+	return &cp
 }
 
-func addProc(proc *common.Process) error {
+func addProc(proc *common.Process) (err error) {
 	if proc.Dir == "" {
 		proc.Dir = procsDir
 	}
+	// Started with the lock held so the process can't be removed on exit
+	// before it's added
 	procs.Apply(func(pp *common.Procs) {
 		proc.Id = nextProcId(*pp)
+		var pl *procLog
+		if !proc.IsPipe() && procLogLines > 0 {
+			if pl, err = newProcLog(proc); err != nil {
+				return
+			}
+		}
+		var cmd *exec.Cmd
+		if cmd, err = proc.PopulateCmd(procsLogDir); err != nil {
+			if pl != nil {
+				pl.discard()
+			}
+			return
+		}
+		if pl != nil {
+			if err = pl.capture(cmd); err != nil {
+				pl.discard()
+				return
+			}
+			proc.WaitOutput = pl.drain
+		}
+		err = proc.Run(procs)
+		if pl != nil {
+			pl.closeWriters()
+		}
+		if err != nil {
+			if pl != nil {
+				pl.discard()
+			}
+			return
+		}
+		*pp = append(*pp, proc)
+		if pl != nil {
+			procLogs.Store(proc.Id, pl)
+		}
+		go func() {
+			<-proc.Done()
+			recordExit(proc, pl)
+		}()
 	})
-	return proc.Run(procs)
+	return
 }
 
 func signalProc(id uint64, signal syscall.Signal) (err error) {
+	err = errNoProc(id)
 	procs.RApply(func(pp *common.Procs) {
-		for _, proc := range *pp {
-			if proc.Id == id {
-				err = proc.Signal(signal)
-				return
-			}
+		if proc := findProcLocked(*pp, id); proc == nil {
+			return
+		} else if proc.Status() == common.ProcExited {
+			err = common.NewError(
+				common.RespErrBadRequest,
+				fmt.Sprintf("process %d has exited", id),
+			)
+		} else {
+			err = proc.Signal(signal)
 		}
 	})
 	return
 }
 
-func handleProcsConn(conn net.Conn) {
+// waitProc waits for the process to exit, returning its exit status, or until
+// cancel is closed.
+func waitProc(id uint64, cancel <-chan struct{}) (common.ExitStatus, error) {
+	proc := getProc(id, false)
+	if proc == nil {
+		return common.ExitStatus{}, errNoProc(id)
+	}
+	select {
+	case <-proc.Done():
+	case <-cancel:
+		return common.ExitStatus{}, common.NewError(
+			common.RespErr, "stopped waiting",
+		)
+	}
+	es, ok := proc.ExitStatus()
+	if !ok {
+		return es, common.NewError(
+			common.RespErr,
+			fmt.Sprintf("exit status of process %d is unavailable", id),
+		)
+	}
+	return es, nil
+}
+
+func errNoProc(id uint64) error {
+	return common.NewError(
+		common.RespErrNotExist,
+		fmt.Sprintf("no process with ID %d", id),
+	)
+}
+
+func handleProcsConn(conn net.Conn, user *User) {
 	defer conn.Close()
 	var buf [1]byte
 
@@ -92,19 +215,132 @@ func handleProcsConn(conn net.Conn) {
 	case common.HeaderGetProcs:
 		handleProcsConnGetProcs(conn)
 	case common.HeaderAddProc:
-		handleProcsConnAddProc(conn)
+		handleProcsConnAddProc(conn, user)
+	case common.HeaderSignalProc:
+		handleProcsConnSignalProc(conn)
+	case common.HeaderWaitProc:
+		handleProcsConnWaitProc(conn)
+	case common.HeaderProcLogs:
+		handleProcsConnProcLogs(conn)
+	case common.HeaderPurgeProcs:
+		handleProcsConnPurgeProcs(conn)
 	default:
-		// TODO
+		common.WriteErrorMsg(
+			conn, common.RespErrBadRequest,
+			fmt.Sprintf("unknown procs header: %d", buf[0]),
+		)
 	}
 }
 
 func handleProcsConnGetProc(conn net.Conn) {
+	var req common.GetProcReq
+	if err := common.ReadJsonFrame(conn, &req); err != nil {
+		common.WriteErrorMsg(conn, common.RespErrBadRequest, err.Error())
+		return
+	}
+	proc := getProc(req.Id, req.Env)
+	if proc == nil {
+		common.WriteError(conn, errNoProc(req.Id))
+		return
+	}
+	if _, err := conn.Write([]byte{common.RespOk}); err != nil {
+		return
+	}
+	common.WriteJsonFrame(conn, proc)
 }
 
 func handleProcsConnGetProcs(conn net.Conn) {
+	var req common.GetProcsReq
+	if err := common.ReadJsonFrame(conn, &req); err != nil {
+		common.WriteErrorMsg(conn, common.RespErrBadRequest, err.Error())
+		return
+	}
+	list, err := listProcs(req)
+	if err != nil {
+		common.WriteError(conn, err)
+		return
+	}
+	if _, err := conn.Write([]byte{common.RespOk}); err != nil {
+		return
+	}
+	common.WriteJsonFrame(conn, list)
+}
+
+func handleProcsConnSignalProc(conn net.Conn) {
+	var buf [9]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return
+	}
+	id := binary.LittleEndian.Uint64(buf[:8])
+	if err := signalProc(id, syscall.Signal(buf[8])); err != nil {
+		common.WriteError(conn, err)
+		return
+	}
+	conn.Write([]byte{common.RespOk})
+}
+
+func handleProcsConnWaitProc(conn net.Conn) {
+	var buf [8]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return
+	}
+	es, err := waitProc(binary.LittleEndian.Uint64(buf[:]), connGone(conn))
+	if err != nil {
+		common.WriteError(conn, err)
+		return
+	}
+	utils.WriteAll(conn, common.AppendExitStatus([]byte{common.RespOk}, es))
 }
 
-func handleProcsConnAddProc(conn net.Conn) {
+func handleProcsConnProcLogs(conn net.Conn) {
+	var req common.ProcLogsReq
+	if err := common.ReadJsonFrame(conn, &req); err != nil {
+		common.WriteErrorMsg(conn, common.RespErrBadRequest, err.Error())
+		return
+	}
+	pl, err := findProcLog(req.Id)
+	if err != nil {
+		common.WriteError(conn, err)
+		return
+	}
+	if _, err := conn.Write([]byte{common.RespOk}); err != nil {
+		return
+	}
+	pl.stream(req, connGone(conn), func(line common.ProcLogLine) error {
+		return common.WriteJsonFrame(conn, line)
+	})
+}
+
+func handleProcsConnPurgeProcs(conn net.Conn) {
+	var req common.PurgeProcsReq
+	if err := common.ReadJsonFrame(conn, &req); err != nil {
+		common.WriteErrorMsg(conn, common.RespErrBadRequest, err.Error())
+		return
+	}
+	purged, err := purgeProcs(req)
+	if err != nil {
+		common.WriteError(conn, err)
+		return
+	}
+	if _, err := conn.Write([]byte{common.RespOk}); err != nil {
+		return
+	}
+	common.WriteJsonFrame(conn, purged)
+}
+
+// connGone returns a channel closed once the client disconnects. It must
+// only be used once the client isn't expected to send anything else.
+func connGone(conn net.Conn) <-chan struct{} {
+	gone := make(chan struct{})
+	go func() {
+		var buf [1]byte
+		conn.Read(buf[:])
+		close(gone)
+	}()
+	return gone
+}
+
+func handleProcsConnAddProc(conn net.Conn, user *User) {
 	buf := make([]byte, 8)
 	if _, err := io.ReadFull(conn, buf); err != nil {
 		return
@@ -115,16 +351,22 @@ func handleProcsConnAddProc(conn net.Conn) {
 	}
 	proc := &common.Process{}
 	if err := json.NewDecoder(lr).Decode(proc); err != nil {
-		writeConnRespMsg(conn, common.RespErr, err.Error())
+		common.WriteErrorMsg(conn, common.RespErrBadRequest, err.Error())
 		return
 	}
-	cmd := proc.PopulateCmd()
-	if proc.Stdout == common.ProcPipe &&
-		proc.Stderr == common.ProcPipe &&
-		proc.Stdin == common.ProcPipe {
-		// TODO: Send conn resp
+	if proc.IsPipe() {
+		if proc.Dir == "" {
+			proc.Dir = procsDir
+		}
+		cmd, err := proc.PopulateCmd(procsLogDir)
+		if err != nil {
+			common.WriteError(conn, err)
+			return
+		}
+		// Any errors are sent as part of the SSH handshake
 		wg := handleSshConnCmd(
 			conn,
+			user,
 			cmd,
 			func() error {
 				return addProc(proc)
@@ -136,12 +378,12 @@ func handleProcsConnAddProc(conn net.Conn) {
 	}
 
 	if err := addProc(proc); err != nil {
-		writeConnRespMsg(conn, common.RespErr, err.Error())
+		common.WriteError(conn, err)
 		return
 	}
 	bytes, err := json.Marshal(proc)
 	if err != nil {
-		writeConnRespMsg(conn, common.RespErr, err.Error())
+		common.WriteError(conn, err)
 		return
 	}
 	_, err = utils.WriteAll(
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/johnietre/gossh/common"
+)
+
+var (
+	recordDir       string
+	recordRetention time.Duration
+	recordMax       int
+
+	pruneMtx sync.Mutex
+)
+
+// recorder records a session's output as an asciicast v2 file.
+type recorder struct {
+	f  *os.File
+	cw *common.CastWriter
+}
+
+func newRecorder(s *sshSession) (*recorder, error) {
+	name := fmt.Sprintf(
+		"%s-%d.cast", s.started.Format("20060102-150405"), s.id,
+	)
+	f, err := os.OpenFile(
+		filepath.Join(recordDir, name),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+		0600,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error creating recording: %w", err)
+	}
+	header := common.CastHeader{
+		Version:   2,
+		Width:     s.size.Cols,
+		Height:    s.size.Rows,
+		Timestamp: s.started.Unix(),
+		Title:     fmt.Sprintf("gossh session %d (%s)", s.id, s.user),
+		Env:       map[string]string{"SHELL": s.cmd.Path},
+		Session:   s.id,
+		User:      s.user,
+		Name:      s.name,
+	}
+	cw, err := common.NewCastWriter(f, header, s.started)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error writing recording: %w", err)
+	}
+	return &recorder{f: f, cw: cw}, nil
+}
+
+func (r *recorder) output(p []byte) {
+	r.logErr(r.cw.Output(p))
+}
+
+func (r *recorder) resize(sz pty.Winsize) {
+	r.logErr(r.cw.Resize(sz))
+}
+
+func (r *recorder) logErr(err error) {
+	if err != nil {
+		log.Printf("Error writing recording %s: %v", r.f.Name(), err)
+	}
+}
+
+func (r *recorder) close() {
+	r.logErr(r.cw.Flush())
+	if err := r.f.Close(); err != nil {
+		log.Printf("Error closing recording %s: %v", r.f.Name(), err)
+	}
+	go pruneRecordings()
+}
+
+// runPruneRecordings prunes recordings every hour.
+func runPruneRecordings() {
+	for {
+		pruneRecordings()
+		time.Sleep(time.Hour)
+	}
+}
+
+// pruneRecordings removes recordings older than the retention period and the
+// oldest recordings beyond the max number of recordings.
+func pruneRecordings() {
+	if recordRetention <= 0 && recordMax <= 0 {
+		return
+	}
+	pruneMtx.Lock()
+	defer pruneMtx.Unlock()
+	recs, err := listRecordingFiles()
+	if err != nil {
+		log.Print("Error listing recordings: ", err)
+		return
+	}
+	// Newest first
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].ModTime().After(recs[j].ModTime())
+	})
+	for i, info := range recs {
+		old := recordRetention > 0 && time.Since(info.ModTime()) > recordRetention
+		if !old && (recordMax <= 0 || i < recordMax) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(recordDir, info.Name())); err != nil {
+			log.Print("Error removing recording: ", err)
+		}
+	}
+}
+
+func listRecordingFiles() ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(recordDir)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".cast") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// listRecordings returns info on the recordings the user can access.
+func listRecordings(user *User) ([]common.RecordingInfo, error) {
+	files, err := listRecordingFiles()
+	if err != nil {
+		return nil, err
+	}
+	recs := []common.RecordingInfo{}
+	for _, file := range files {
+		header, err := readCastHeader(filepath.Join(recordDir, file.Name()))
+		if err != nil || !user.canManage(header.User) {
+			continue
+		}
+		recs = append(recs, common.RecordingInfo{
+			Name:    file.Name(),
+			Session: header.Session,
+			User:    header.User,
+			Start:   header.Timestamp,
+			Size:    file.Size(),
+		})
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].Name < recs[j].Name
+	})
+	return recs, nil
+}
+
+// openRecording opens the recording with the given name, checking that the
+// user can access it.
+func openRecording(user *User, name string) (*os.File, error) {
+	if name != filepath.Base(name) || !strings.HasSuffix(name, ".cast") {
+		return nil, common.NewError(
+			common.RespErrBadRequest, "invalid recording name",
+		)
+	}
+	path := filepath.Join(recordDir, name)
+	header, err := readCastHeader(path)
+	if err != nil {
+		return nil, err
+	} else if !user.canManage(header.User) {
+		return nil, common.NewError(
+			common.RespErrPermission,
+			fmt.Sprintf("recording %q belongs to another user", name),
+		)
+	}
+	return os.Open(path)
+}
+
+func readCastHeader(path string) (header common.CastHeader, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(line, &header)
+	return
+}
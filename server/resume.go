@@ -0,0 +1,154 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/johnietre/gossh/common"
+	utils "github.com/johnietre/utils/go"
+)
+
+var (
+	// How long a client's place in a session is kept after its connection is
+	// lost (0 disables resuming)
+	resumeGrace time.Duration
+	resumeSlots = utils.NewSyncMap[string, *resumeSlot]()
+)
+
+// resumeSlot is a client's place in a session, kept for a grace period after
+// the client's connection is lost so it can resume without losing or
+// duplicating input or output.
+type resumeSlot struct {
+	token    string
+	sess     *sshSession
+	user     string
+	readOnly bool
+	// Bytes of input received from the client, across connections
+	inputReceived atomic.Uint64
+
+	// Guarded by the session's lock
+	mode clientMode
+	// The connected client, nil while waiting for the client to resume
+	client *sessionClient
+	timer  *time.Timer
+}
+
+// newSlotLocked creates a slot for the client. Must be called with the lock
+// held.
+func (s *sshSession) newSlotLocked(c *sessionClient) (*resumeSlot, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	slot := &resumeSlot{
+		token:    hex.EncodeToString(b[:]),
+		sess:     s,
+		user:     c.user,
+		readOnly: c.readOnly,
+		mode:     c.getMode(),
+		client:   c,
+	}
+	s.slots[slot] = utils.Unit{}
+	resumeSlots.Store(slot.token, slot)
+	return slot, nil
+}
+
+// removeSlotLocked must be called with the lock held.
+func (s *sshSession) removeSlotLocked(slot *resumeSlot) {
+	if slot.timer != nil {
+		slot.timer.Stop()
+		slot.timer = nil
+	}
+	delete(s.slots, slot)
+	resumeSlots.Delete(slot.token)
+}
+
+// expireSlot removes the slot if the client hasn't resumed, ending the session
+// if it was the last owner of a non-persistent session.
+func (s *sshSession) expireSlot(slot *resumeSlot) {
+	s.mtx.Lock()
+	if _, ok := s.slots[slot]; !ok || slot.client != nil {
+		s.mtx.Unlock()
+		return
+	}
+	s.removeSlotLocked(slot)
+	orphaned := s.orphanedLocked()
+	s.mtx.Unlock()
+	if orphaned {
+		s.kill("owner disconnected")
+	}
+}
+
+func findResumeSlot(user *User, token string) (*resumeSlot, error) {
+	slot, ok := resumeSlots.Load(token)
+	if !ok || slot.user != user.Name {
+		return nil, common.NewError(
+			common.RespErrNotExist, "resume token is invalid or expired",
+		)
+	}
+	return slot, nil
+}
+
+// resume attaches the client in place of the slot's previous client, sending
+// the output since offset, and blocks until the client is detached.
+func (s *sshSession) resume(
+	c *sessionClient, slot *resumeSlot, offset uint64,
+) error {
+	s.mtx.Lock()
+	old := slot.client
+	s.mtx.Unlock()
+	if old != nil {
+		// The old connection may not have been noticed as lost yet. Wait for it
+		// to stop reading input so the input received is accurate.
+		old.close()
+		timer := time.NewTimer(time.Second * 5)
+		select {
+		case <-old.inputDone:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+
+	s.mtx.Lock()
+	if s.ended {
+		s.mtx.Unlock()
+		return common.NewError(
+			common.RespErrNotExist,
+			fmt.Sprintf("session %d has ended", s.id),
+		)
+	} else if _, ok := s.slots[slot]; !ok || (slot.client != nil && slot.client != old) {
+		s.mtx.Unlock()
+		return common.NewError(
+			common.RespErrNotExist, "resume token is invalid or expired",
+		)
+	} else if offset > s.output.total {
+		s.mtx.Unlock()
+		return common.NewError(
+			common.RespErrBadRequest,
+			fmt.Sprintf("offset %d is past the end of the output", offset),
+		)
+	}
+	if slot.timer != nil {
+		slot.timer.Stop()
+		slot.timer = nil
+	}
+	c.slot, slot.client, slot.mode = slot, c, c.getMode()
+	s.clients[c] = utils.Unit{}
+	s.peer = peerAddr(c.conn)
+	audit(auditEvent{
+		Event:   "session-resume",
+		User:    c.user,
+		Session: s.id,
+		Peer:    s.peer,
+	})
+	start, data := s.output.Since(offset)
+	s.queueAttachRespLocked(c, start, data)
+	s.resizeLocked()
+	s.mtx.Unlock()
+
+	s.serve(c)
+	return nil
+}
@@ -5,10 +5,12 @@ import (
 	"log"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/johnietre/gossh/common"
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
 )
 
 var (
@@ -41,11 +43,22 @@ The password, if desired, can be set using the ` + common.PasswordEnvName + ` en
 			if sshDir == "" {
 				sshDir = procsDir
 			}
+			if shareSizePolicy != "owner" && shareSizePolicy != "smallest" {
+				log.Fatal("Invalid --share-size: ", shareSizePolicy)
+			}
 			if noSsh && noProcs {
 				log.Fatal("Must start at least one type of server (SSH, Procs, etc.)")
 			} else if noTcp && noHttp {
 				log.Fatal("Must allow at least one type of connection (TCP, HTTP, etc.)")
 			}
+			if sshListenAddr != "" && noSsh {
+				log.Fatal("--ssh-listen requires the SSH server")
+			}
+			if serveWeb && (noSsh || noHttp) {
+				log.Fatal("--web requires both the SSH server and HTTP connections")
+			} else if serveWeb && !webVendored() {
+				log.Fatal(`--web requires the web terminal's dependencies to be vendored when building (run "make web-vendor")`)
+			}
 			if l := len(args); l == 1 {
 				addr = args[0]
 			} else if l != 0 {
@@ -71,15 +84,158 @@ The password, if desired, can be set using the ` + common.PasswordEnvName + ` en
 		&sshDir, "sdir", "D", "",
 		"Directory to start SSH connections in. Follows same rules as --dir",
 	)
+	flags.StringVar(
+		&procsLogDir, "procs-log-dir", "",
+		`Directory for the log files of processes with "log" as their stdout or stderr (disabled if empty)`,
+	)
+	flags.IntVar(
+		&procLogLines, "procs-log-lines", 1000,
+		"Number of lines of each process's output kept for the logs API (0 disables capturing output)",
+	)
+	flags.BoolVar(
+		&procLogSpill, "procs-log-spill", false,
+		"Keep output lines dropped from memory in files in --procs-log-dir until the process exits (after which only the lines in memory are kept)",
+	)
+	flags.IntVar(
+		&procHistoryMax, "procs-history", 100,
+		"Max number of exited processes to keep, removing the oldest first (negative means no limit)",
+	)
+	flags.DurationVar(
+		&procHistoryRetention, "procs-history-retention", 0,
+		"How long to keep exited processes (0 keeps them until removed by --procs-history)",
+	)
 	flags.BoolVar(&noSsh, "nossh", false, "Don't start SSH server")
 	flags.BoolVar(&noProcs, "noprocs", false, "Don't start procs server")
 	flags.BoolVar(&noTcp, "notcp", false, "Don't allow plain TCP connections, must be HTTP(s)")
 	flags.BoolVar(&noHttp, "nohttp", false, "Don't allow HTTP requests/connections")
-	flags.StringVar(&shell, "shell", "bash", "The shell to use for SSH")
+	flags.StringVar(&shell, "shell", "bash", "The shell to use for SSH (can be set per user in the config)")
+	flags.BoolVar(
+		&loginShell, "login-shell", false,
+		`Start shells as login shells (with argv[0] prefixed with "-")`,
+	)
+	flags.StringVar(
+		&bannerPath, "banner", "",
+		"Path to a banner shown to clients before they log in",
+	)
+	flags.StringVar(
+		&motdPath, "motd", "",
+		"Path to a message of the day shown at the start of shell sessions. It's a Go template with .User, .Hostname, .Time, .LastLogin (.Time and .Peer, nil if none), .Procs (running procs), and .Sessions (the user's running sessions)",
+	)
+	flags.StringVar(
+		&sshListenAddr, "ssh-listen", "",
+		"Address to accept SSH protocol connections on so standard ssh/scp clients can be used (disabled if empty)",
+	)
+	flags.StringVar(
+		&sshHostKeyPath, "ssh-host-key", "gossh_host_key",
+		"Path to the host key for --ssh-listen, which is generated if it doesn't exist",
+	)
+	flags.StringVar(
+		&sftpServerPath, "sftp-server", "",
+		"Path to the sftp-server program used for the SFTP subsystem of --ssh-listen (looked for in common locations if empty)",
+	)
+	flags.BoolVar(
+		&serveWeb, "web", false,
+		"Serve a browser-based terminal at /web/ which connects to the SSH server over HTTP",
+	)
+	flags.StringSliceVar(
+		&acceptEnv, "accept-env", []string{"LANG", "LC_*", "TERM", "COLORTERM"},
+		"Patterns of environment variables SSH clients are allowed to set",
+	)
+	flags.StringVar(
+		&shareSizePolicy, "share-size", "owner",
+		`How shared SSH session sizes are chosen: "owner" (the owner's size wins) or "smallest" (the smallest attached client wins)`,
+	)
+	flags.StringVar(
+		&recordDir, "record-dir", "",
+		"Directory to record SSH sessions to as asciicast v2 files (recording is disabled if empty)",
+	)
+	flags.DurationVar(
+		&recordRetention, "record-retention", 0,
+		"How long to keep recordings (0 keeps them forever)",
+	)
+	flags.IntVar(
+		&recordMax, "record-max", 0,
+		"Max number of recordings to keep, removing the oldest first (0 means no limit)",
+	)
+	flags.StringSliceVar(
+		&allowForward, "allow-forward", nil,
+		`Patterns of HOST:PORT addresses clients are allowed to forward to (e.g., "localhost:5432" or "10.0.0.*:*"). Hostnames are resolved and forwarding is allowed if either the given address or a resolved IP matches. Forwarding is denied if empty`,
+	)
+	flags.StringSliceVar(
+		&denyForward, "deny-forward", nil,
+		"Patterns of HOST:PORT addresses clients aren't allowed to forward to, taking precedence over --allow-forward. Forwarding is denied if either the given address or any IP it resolves to matches",
+	)
+	flags.StringSliceVar(
+		&allowRemoteForward, "allow-remote-forward", nil,
+		`Patterns of HOST:PORT addresses clients are allowed to have the server listen on for remote forwards (e.g., "localhost:90*"). Remote forwarding is denied if empty`,
+	)
+	flags.IntVar(
+		&remoteForwardLimit, "remote-forward-limit", 4,
+		"Max number of remote forwards each user can have at once (0 means no limit)",
+	)
+	flags.DurationVar(
+		&idleTimeout, "idle-timeout", 0,
+		"How long SSH sessions can go without input before being ended (0 means no limit). Can be overridden per user or group in the config",
+	)
+	flags.DurationVar(
+		&maxSessionDuration, "max-session-duration", 0,
+		"How long SSH sessions can run before being ended (0 means no limit). Can be overridden per user or group in the config",
+	)
+	flags.DurationVar(
+		&sessionWarning, "session-warning", 5*time.Minute,
+		"How long before an SSH session is ended by --idle-timeout or --max-session-duration to warn its clients (0 disables warnings)",
+	)
+	flags.StringVar(
+		&auditLogPath, "audit-log", "",
+		"File to append an audit log of SSH session events to as JSON lines (disabled if empty)",
+	)
+	flags.StringVar(
+		&configPath, "config", "",
+		`Path to JSON config file (users, etc.). Without users, all clients log in as a single admin user named "gossh"`,
+	)
+	flags.IntVar(
+		&scrollbackLen, "scrollback", 1<<16,
+		"Number of bytes of SSH session output kept for clients reattaching or resuming",
+	)
+	flags.DurationVar(
+		&resumeGrace, "resume-grace", time.Minute,
+		"How long to keep an SSH client's place in a session after its connection is lost so it can resume (0 disables resuming)",
+	)
+	cmd.AddCommand(getHashPasswordCmd())
 	return cmd
 }
 
+func getHashPasswordCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "hash-password",
+		Short: "Hash a password for use in the server config",
+		Long:  "Reads a password from the terminal and prints its bcrypt hash, suitable for use as the passwordHash of a user in the server config.",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Fprint(os.Stderr, "Password: ")
+			pwd, err := term.ReadPassword(int(os.Stdin.Fd()))
+			fmt.Fprintln(os.Stderr)
+			if err != nil {
+				log.Fatal("Error reading password: ", err)
+			}
+			hash, err := bcrypt.GenerateFromPassword(pwd, bcrypt.DefaultCost)
+			if err != nil {
+				log.Fatal("Error hashing password: ", err)
+			}
+			fmt.Println(string(hash))
+		},
+	}
+}
+
 func runServer(addr string) {
+	if configPath != "" {
+		c, err := loadConfig(configPath)
+		if err != nil {
+			log.Fatal("Error loading config: ", err)
+		}
+		config = c
+	}
+
 	password := os.Getenv(common.PasswordEnvName)
 	if password != "" {
 		err := os.Setenv(common.PasswordEnvName, "")
@@ -96,6 +252,48 @@ func runServer(addr string) {
 		hasPassword = true
 	}
 
+	if err := checkForwardPatterns(allowForward); err != nil {
+		log.Fatal("Error checking --allow-forward: ", err)
+	}
+	if err := checkForwardPatterns(denyForward); err != nil {
+		log.Fatal("Error checking --deny-forward: ", err)
+	}
+	if err := checkForwardPatterns(allowRemoteForward); err != nil {
+		log.Fatal("Error checking --allow-remote-forward: ", err)
+	}
+
+	if err := loadLoginFiles(); err != nil {
+		log.Fatal(err)
+	}
+
+	if auditLogPath != "" {
+		if err := openAuditLog(auditLogPath); err != nil {
+			log.Fatal("Error opening audit log: ", err)
+		}
+	}
+
+	if recordDir != "" {
+		if err := os.MkdirAll(recordDir, 0700); err != nil {
+			log.Fatal("Error creating recording directory: ", err)
+		}
+		log.Printf("Recording SSH sessions to %s", recordDir)
+		go runPruneRecordings()
+	}
+
+	if procLogSpill && procsLogDir == "" {
+		log.Fatal("--procs-log-spill requires --procs-log-dir")
+	} else if procLogLines < 0 {
+		log.Fatal("--procs-log-lines must not be negative")
+	}
+	if procHistoryRetention > 0 && !noProcs {
+		go runPruneProcHistory()
+	}
+	if procsLogDir != "" && !noProcs {
+		if err := os.MkdirAll(procsLogDir, 0755); err != nil {
+			log.Fatal("Error creating procs log directory: ", err)
+		}
+	}
+
 	ln, err := Listen("tcp", addr)
 	if err != nil {
 		log.Fatal("Error listening: ", err)
@@ -114,6 +312,11 @@ func runServer(addr string) {
 		log.Printf("Using %s as procs working directory", procsDir)
 	}
 	log.Print("Listening on ", addr)
+	if sshListenAddr != "" {
+		go func() {
+			log.Fatal("Error running SSH protocol listener: ", runSshd(sshListenAddr))
+		}()
+	}
 
 	var wg sync.WaitGroup
 	if !noTcp {
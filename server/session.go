@@ -0,0 +1,988 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/johnietre/gossh/common"
+	utils "github.com/johnietre/utils/go"
+	webs "golang.org/x/net/websocket"
+)
+
+var (
+	sessions     = utils.NewSyncMap[uint64, *sshSession]()
+	sessionNames = utils.NewSyncMap[string, *sshSession]()
+
+	scrollbackLen int
+	// Either "owner" or "smallest"
+	shareSizePolicy string
+)
+
+// The number of chunks of output queued for a client before it's considered
+// too slow and dropped.
+const clientQueueLen = 256
+
+// How often to check whether the pty echoes input, in addition to whenever
+// there's output.
+const echoCheckInterval = time.Millisecond * 200
+
+// sshSession is a shell (or piped process) running in a pty. Persistent
+// sessions outlive the client connection and can be reattached to. Multiple
+// clients can be attached at once, with the owner (and admins) having full
+// control and other users only being able to attach if the session is shared
+// with them.
+type sshSession struct {
+	id      uint64
+	name    string
+	user    string
+	persist bool
+	// Whether the session was started by a user with a forced command, which
+	// are the only sessions such users can attach to
+	forced  bool
+	cmd     *exec.Cmd
+	pty     *os.File
+	started time.Time
+
+	bytesIn, bytesOut atomic.Uint64
+	// When input was last written (Unix nanoseconds)
+	lastInput atomic.Int64
+	// Whether the pty echoes typed input (see ptyEchoes)
+	echoes atomic.Bool
+
+	mtx     sync.Mutex
+	output  *ringBuf
+	clients map[*sessionClient]utils.Unit
+	slots   map[*resumeSlot]utils.Unit
+	// Maps usernames to whether they can write
+	shares   map[string]bool
+	rec      *recorder
+	peer     string
+	size     pty.Winsize
+	ended    bool
+	pumpDone chan utils.Unit
+	done     chan utils.Unit
+	// Why the session was killed, if it was
+	endReason string
+}
+
+func startSession(
+	id uint64,
+	user *User,
+	req common.SshReq,
+	cmd *exec.Cmd,
+	sz *pty.Winsize,
+	motd []byte,
+	start, wait func() error,
+) (*sshSession, error) {
+	s := &sshSession{
+		id:       id,
+		name:     req.Name,
+		user:     user.Name,
+		persist:  req.Persist || req.Name != "",
+		forced:   len(user.ForceCommand) != 0,
+		cmd:      cmd,
+		started:  time.Now(),
+		output:   newRingBuf(scrollbackLen),
+		clients:  make(map[*sessionClient]utils.Unit),
+		slots:    make(map[*resumeSlot]utils.Unit),
+		shares:   make(map[string]bool),
+		size:     *sz,
+		pumpDone: make(chan utils.Unit),
+		done:     make(chan utils.Unit),
+	}
+	for name, write := range req.Shares {
+		s.shares[name] = write
+	}
+	if s.name != "" {
+		if _, err := strconv.ParseUint(s.name, 10, 64); err == nil {
+			return nil, common.NewError(
+				common.RespErrBadRequest, "session name cannot be a number",
+			)
+		}
+		if _, loaded := sessionNames.LoadOrStore(s.name, s); loaded {
+			return nil, common.NewError(
+				common.RespErrBadRequest,
+				fmt.Sprintf("session name %q already in use", s.name),
+			)
+		}
+	}
+	if recordDir != "" {
+		rec, err := newRecorder(s)
+		if err != nil {
+			if s.name != "" {
+				sessionNames.Delete(s.name)
+			}
+			return nil, err
+		}
+		s.rec = rec
+	}
+	f, err := startWithSize(cmd, sz, start)
+	if err != nil || f == nil {
+		if err == nil {
+			err = fmt.Errorf("file returned was nil")
+		}
+		if s.name != "" {
+			sessionNames.Delete(s.name)
+		}
+		if s.rec != nil {
+			s.rec.close()
+		}
+		return nil, err
+	}
+	s.pty = f
+	echoes, _ := ptyEchoes(f)
+	s.echoes.Store(echoes)
+	if len(motd) != 0 {
+		// Written before any of the command's output is read
+		s.broadcast(motd)
+	}
+	s.lastInput.Store(time.Now().UnixNano())
+	sessions.Store(id, s)
+	audit(auditEvent{
+		Event:   "session-start",
+		User:    s.user,
+		Session: s.id,
+		Command: cmd.Args,
+	})
+	go s.pump()
+	go s.run(wait)
+	go s.watchEcho()
+	if idle, maxDur := user.sessionPolicy(); idle > 0 || maxDur > 0 {
+		go s.enforcePolicy(idle, maxDur)
+	}
+	return s, nil
+}
+
+// findSession finds a running session by ID or name.
+func findSession(idOrName string) (*sshSession, error) {
+	if id, err := strconv.ParseUint(idOrName, 10, 64); err == nil {
+		if s, ok := sessions.Load(id); ok {
+			return s, nil
+		}
+	} else if s, ok := sessionNames.Load(idOrName); ok {
+		return s, nil
+	}
+	return nil, common.NewError(
+		common.RespErrNotExist,
+		fmt.Sprintf("no session %q", idOrName),
+	)
+}
+
+// findUserSession finds a running session by ID or name, checking that the
+// user is allowed to manage it.
+func findUserSession(user *User, idOrName string) (*sshSession, error) {
+	s, err := findSession(idOrName)
+	if err != nil {
+		return nil, err
+	} else if !user.canManage(s.user) {
+		return nil, common.NewError(
+			common.RespErrPermission,
+			fmt.Sprintf("session %q belongs to another user", idOrName),
+		)
+	}
+	return s, nil
+}
+
+// listSessions returns info on the sessions the user can manage or that are
+// shared with the user.
+func listSessions(user *User) []common.SessionInfo {
+	infos := []common.SessionInfo{}
+	sessions.Range(func(_ uint64, s *sshSession) bool {
+		if user.canManage(s.user) || s.isSharedWith(user.Name) {
+			infos = append(infos, s.info())
+		}
+		return true
+	})
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Id < infos[j].Id
+	})
+	return infos
+}
+
+func killSession(user *User, req common.KillSessionReq) error {
+	s, err := findUserSession(user, req.Session)
+	if err != nil {
+		return err
+	}
+	reason := req.Reason
+	if reason == "" {
+		reason = "killed by " + user.Name
+	}
+	log.Printf("Session %d: killed by %s: %s", s.id, user.Name, reason)
+	s.kill(reason)
+	return nil
+}
+
+func shareSession(user *User, req common.ShareSessionReq) error {
+	s, err := findUserSession(user, req.Session)
+	if err != nil {
+		return err
+	}
+	if req.User == s.user {
+		return common.NewError(
+			common.RespErrBadRequest, "cannot share session with its owner",
+		)
+	}
+	if req.Remove {
+		s.unshare(req.User)
+	} else {
+		s.share(req.User, req.Write)
+	}
+	return nil
+}
+
+func (s *sshSession) info() common.SessionInfo {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	info := common.SessionInfo{
+		Id:       s.id,
+		Name:     s.name,
+		User:     s.user,
+		Peer:     s.peer,
+		Start:    s.started.Unix(),
+		Command:  strings.Join(s.cmd.Args, " "),
+		Rows:     s.size.Rows,
+		Cols:     s.size.Cols,
+		BytesIn:  s.bytesIn.Load(),
+		BytesOut: s.bytesOut.Load(),
+		Persist:  s.persist,
+		Attached: len(s.clients) != 0,
+		Clients:  []common.SessionClientInfo{},
+		Shares:   make(map[string]bool, len(s.shares)),
+	}
+	for c := range s.clients {
+		info.Clients = append(info.Clients, common.SessionClientInfo{
+			User: c.user,
+			Peer: peerAddr(c.conn),
+			Mode: c.getMode().String(),
+		})
+	}
+	sort.Slice(info.Clients, func(i, j int) bool {
+		return info.Clients[i].Peer < info.Clients[j].Peer
+	})
+	for name, write := range s.shares {
+		info.Shares[name] = write
+	}
+	return info
+}
+
+// accessFor returns the mode a user would attach to the session with.
+func (s *sshSession) accessFor(user *User, readOnly bool) (clientMode, error) {
+	if len(user.ForceCommand) != 0 && !(s.forced && s.user == user.Name) {
+		// Otherwise, the user could get a shell they aren't allowed
+		return 0, common.NewError(
+			common.RespErrPermission,
+			fmt.Sprintf(
+				"%s can only attach to sessions running their forced command",
+				user.Name,
+			),
+		)
+	}
+	if user.canManage(s.user) {
+		if readOnly {
+			return clientRead, nil
+		}
+		return clientOwner, nil
+	}
+	s.mtx.Lock()
+	write, ok := s.shares[user.Name]
+	s.mtx.Unlock()
+	if !ok {
+		return 0, common.NewError(
+			common.RespErrPermission,
+			fmt.Sprintf("session %d is not shared with %s", s.id, user.Name),
+		)
+	} else if write && !readOnly {
+		return clientWrite, nil
+	}
+	return clientRead, nil
+}
+
+func (s *sshSession) isSharedWith(name string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, ok := s.shares[name]
+	return ok
+}
+
+// share shares the session with the user, updating the mode of any of the
+// user's attached clients.
+func (s *sshSession) share(name string, write bool) {
+	mode := clientRead
+	if write {
+		mode = clientWrite
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.shares[name] = write
+	for c := range s.clients {
+		if c.user == name && c.getMode() != clientOwner && !c.readOnly {
+			c.mode.Store(int32(mode))
+		}
+	}
+}
+
+// unshare stops sharing the session with the user, dropping any of the
+// user's attached clients.
+func (s *sshSession) unshare(name string) {
+	s.mtx.Lock()
+	delete(s.shares, name)
+	var dropped []*sessionClient
+	for c := range s.clients {
+		if c.user == name && c.getMode() != clientOwner {
+			dropped = append(dropped, c)
+		}
+	}
+	s.mtx.Unlock()
+	for _, c := range dropped {
+		c.sendClose("access revoked")
+		c.close()
+	}
+}
+
+func (s *sshSession) pump() {
+	defer close(s.pumpDone)
+	buf := make([]byte, 1<<15)
+	for {
+		n, err := s.pty.Read(buf)
+		if n > 0 {
+			// Checked before broadcasting so clients know input is hidden before
+			// seeing a password prompt
+			s.checkEcho()
+			s.broadcast(buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// checkEcho notifies clients that asked for echo events if whether the pty
+// echoes input has changed.
+func (s *sshSession) checkEcho() {
+	echoes, err := ptyEchoes(s.pty)
+	if err != nil || s.echoes.Swap(echoes) == echoes {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for c := range s.clients {
+		if c.echoEvents {
+			select {
+			case c.echoChanged <- utils.Unit{}:
+			default:
+			}
+		}
+	}
+}
+
+// watchEcho periodically checks whether the pty echoes input, since programs
+// don't always write output after turning echo off.
+func (s *sshSession) watchEcho() {
+	ticker := time.NewTicker(echoCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.checkEcho()
+		case <-s.pumpDone:
+			return
+		}
+	}
+}
+
+// sendEchoEvents sends the client whether the pty echoes input, and again
+// whenever it changes, until the client is closed.
+func (s *sshSession) sendEchoEvents(c *sessionClient) {
+	sent := false
+	var last bool
+	for {
+		echoes := s.echoes.Load()
+		if !sent || echoes != last {
+			b := []byte{common.ActionEcho, 0}
+			if echoes {
+				b[1] = 1
+			}
+			if err := c.writeCtrl(b); err != nil {
+				return
+			}
+			sent, last = true, echoes
+		}
+		select {
+		case <-c.echoChanged:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (s *sshSession) broadcast(p []byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.ended {
+		return
+	}
+	s.output.Write(p)
+	s.bytesOut.Add(uint64(len(p)))
+	if s.rec != nil {
+		s.rec.output(p)
+	}
+	if len(s.clients) == 0 {
+		return
+	}
+	b := append([]byte(nil), p...)
+	for c := range s.clients {
+		if c.dropped.Load() {
+			continue
+		} else if !c.queue(b) && !c.dropped.Swap(true) {
+			// Don't let slow clients hold up the session
+			go func(c *sessionClient) {
+				c.sendClose("too slow to keep up with output")
+				c.close()
+			}(c)
+		}
+	}
+}
+
+func (s *sshSession) run(wait func() error) {
+	if err := wait(); err != nil {
+		log.Printf("Session %d: error waiting: %v", s.id, err)
+	}
+	// Give any remaining output a chance to be sent
+	timer := time.NewTimer(time.Second)
+	select {
+	case <-s.pumpDone:
+		timer.Stop()
+	case <-timer.C:
+	}
+	s.pty.Close()
+
+	var exit *common.ExitStatus
+	if s.cmd.ProcessState != nil {
+		es := common.ExitStatusFromState(s.cmd.ProcessState)
+		exit = &es
+	}
+
+	s.mtx.Lock()
+	s.ended = true
+	audit(auditEvent{
+		Event:   "session-end",
+		User:    s.user,
+		Session: s.id,
+		Reason:  s.endReason,
+		Exit:    exit,
+	})
+	// Clients are sent the exit status and closed once their queued output is
+	// written
+	for c := range s.clients {
+		c.exit = exit
+		close(c.out)
+	}
+	for slot := range s.slots {
+		s.removeSlotLocked(slot)
+	}
+	if s.rec != nil {
+		s.rec.close()
+	}
+	s.mtx.Unlock()
+	sessions.Delete(s.id)
+	if s.name != "" {
+		sessionNames.Delete(s.name)
+	}
+	close(s.done)
+}
+
+// attach attaches the client to the session and blocks until the client is
+// detached. If detachOthers is true, all other clients are detached.
+func (s *sshSession) attach(c *sessionClient, detachOthers bool) error {
+	s.mtx.Lock()
+	if s.ended {
+		s.mtx.Unlock()
+		return common.NewError(
+			common.RespErrNotExist,
+			fmt.Sprintf("session %d has ended", s.id),
+		)
+	}
+	var others []*sessionClient
+	if detachOthers {
+		for other := range s.clients {
+			others = append(others, other)
+		}
+	}
+	if resumeGrace > 0 && !c.plain {
+		slot, err := s.newSlotLocked(c)
+		if err != nil {
+			s.mtx.Unlock()
+			return err
+		}
+		c.slot = slot
+	}
+	s.clients[c] = utils.Unit{}
+	s.peer = peerAddr(c.conn)
+	audit(auditEvent{
+		Event:   "session-attach",
+		User:    c.user,
+		Session: s.id,
+		Peer:    s.peer,
+	})
+	// Send the scrollback so the client can restore the screen
+	data := s.output.Bytes()
+	s.queueAttachRespLocked(c, s.output.total-uint64(len(data)), data)
+	s.resizeLocked()
+	s.mtx.Unlock()
+	for _, other := range others {
+		other.sendClose("detached by another client")
+		other.close()
+	}
+
+	s.serve(c)
+	return nil
+}
+
+// queueAttachRespLocked queues the attach response followed by the output
+// starting at the given offset. Must be called with the lock held.
+func (s *sshSession) queueAttachRespLocked(
+	c *sessionClient, offset uint64, data []byte,
+) {
+	if c.plain {
+		if len(data) != 0 {
+			c.queue(data)
+		}
+		return
+	}
+	resp := common.AttachResp{Session: s.id, Offset: offset}
+	if c.slot != nil {
+		resp.Token = c.slot.token
+		resp.InputReceived = c.slot.inputReceived.Load()
+	}
+	c.queue(append(common.AppendAttachResp(nil, resp), data...))
+}
+
+// serve handles the attached client until it's detached.
+func (s *sshSession) serve(c *sessionClient) {
+	go c.writeOutput()
+	go s.handleInput(c)
+	go s.handleControl(c)
+	if c.echoEvents {
+		go s.sendEchoEvents(c)
+	}
+	<-c.done
+	s.detach(c)
+}
+
+func (s *sshSession) detach(c *sessionClient) {
+	s.mtx.Lock()
+	if _, ok := s.clients[c]; !ok {
+		s.mtx.Unlock()
+		return
+	}
+	delete(s.clients, c)
+	if slot := c.slot; slot != nil && slot.client == c {
+		slot.client = nil
+		if c.noResume.Load() || s.ended {
+			s.removeSlotLocked(slot)
+		} else {
+			// Keep the client's place until it resumes or the grace period ends
+			slot.timer = time.AfterFunc(resumeGrace, func() {
+				s.expireSlot(slot)
+			})
+		}
+	}
+	s.resizeLocked()
+	orphaned := s.orphanedLocked()
+	s.mtx.Unlock()
+	if orphaned {
+		s.kill("owner disconnected")
+	}
+}
+
+// orphanedLocked returns whether the session should end since it's not
+// persistent and there are no clients with control, including those that may
+// resume. Must be called with the lock held.
+func (s *sshSession) orphanedLocked() bool {
+	if s.ended || s.persist {
+		return false
+	}
+	for c := range s.clients {
+		if c.getMode() == clientOwner {
+			return false
+		}
+	}
+	for slot := range s.slots {
+		if slot.mode == clientOwner {
+			return false
+		}
+	}
+	return true
+}
+
+// resizeLocked resizes the pty based on the sizes of the attached clients and
+// the share size policy. Must be called with the lock held.
+func (s *sshSession) resizeLocked() {
+	var owners, all []*sessionClient
+	for c := range s.clients {
+		if c.size.Rows == 0 || c.size.Cols == 0 {
+			continue
+		}
+		all = append(all, c)
+		if c.getMode() == clientOwner {
+			owners = append(owners, c)
+		}
+	}
+	candidates := all
+	if shareSizePolicy == "owner" && len(owners) != 0 {
+		candidates = owners
+	}
+	if len(candidates) == 0 {
+		return
+	}
+	sz := candidates[0].size
+	for _, c := range candidates[1:] {
+		if c.size.Rows < sz.Rows {
+			sz.Rows, sz.Y = c.size.Rows, c.size.Y
+		}
+		if c.size.Cols < sz.Cols {
+			sz.Cols, sz.X = c.size.Cols, c.size.X
+		}
+	}
+	if sz == s.size {
+		return
+	}
+	if err := pty.Setsize(s.pty, &sz); err != nil {
+		// TODO
+		return
+	}
+	s.size = sz
+	if s.rec != nil {
+		s.rec.resize(sz)
+	}
+}
+
+// kill notifies the attached clients, if any, of the reason and terminates
+// the session.
+func (s *sshSession) kill(reason string) {
+	s.mtx.Lock()
+	if s.endReason == "" {
+		s.endReason = reason
+	}
+	clients := make([]*sessionClient, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mtx.Unlock()
+	for _, c := range clients {
+		c.sendClose(reason)
+		c.close()
+	}
+	s.terminate()
+}
+
+// terminate hangs up the session, killing the process if it hasn't exited
+// after a few seconds.
+func (s *sshSession) terminate() {
+	if s.cmd.Process != nil {
+		s.cmd.Process.Signal(syscall.SIGHUP)
+	}
+	s.pty.Close()
+	go func() {
+		timer := time.NewTimer(time.Second * 5)
+		select {
+		case <-s.done:
+			timer.Stop()
+		case <-timer.C:
+			if s.cmd.Process != nil {
+				s.cmd.Process.Kill()
+			}
+		}
+	}()
+}
+
+// signal sends the signal to the session's foreground process group.
+func (s *sshSession) signal(sig syscall.Signal) {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	if err := signalPty(s.cmd, s.pty, sig); err != nil {
+		log.Printf("Session %d: error sending %v: %v", s.id, sig, err)
+	}
+}
+
+func (s *sshSession) handleInput(c *sessionClient) {
+	defer close(c.inputDone)
+	buf := make([]byte, 1<<12)
+	for {
+		n, err := c.conn.Read(buf)
+		if c.slot != nil {
+			c.slot.inputReceived.Add(uint64(n))
+		}
+		// Input from read-only clients is discarded
+		if n > 0 && c.getMode() != clientRead {
+			if _, err := s.pty.Write(buf[:n]); err != nil {
+				break
+			}
+			s.bytesIn.Add(uint64(n))
+			s.lastInput.Store(time.Now().UnixNano())
+		}
+		if err != nil {
+			break
+		}
+	}
+	c.close()
+}
+
+func (s *sshSession) handleControl(c *sessionClient) {
+	var buf [128]byte
+	for {
+		_, err := c.ctrl.Read(buf[:1])
+		if err != nil {
+			break
+		}
+		if buf[0] == common.ActionDetach {
+			c.noResume.Store(true)
+		} else if buf[0] == common.ActionSignal {
+			if _, err := io.ReadFull(c.ctrl, buf[:1]); err != nil {
+				break
+			}
+			// Read-only clients can't signal
+			if c.getMode() != clientRead {
+				s.signal(syscall.Signal(buf[0]))
+			}
+		} else if buf[0] == common.ActionResize {
+			if _, err := io.ReadFull(c.ctrl, buf[:8]); err != nil {
+				break
+			}
+			s.mtx.Lock()
+			c.size = common.WinsizeFromBytes(buf[:8])
+			s.resizeLocked()
+			s.mtx.Unlock()
+		}
+	}
+	c.close()
+}
+
+type clientMode int32
+
+const (
+	clientRead clientMode = iota
+	clientWrite
+	clientOwner
+)
+
+func (m clientMode) String() string {
+	switch m {
+	case clientRead:
+		return "read"
+	case clientWrite:
+		return "write"
+	case clientOwner:
+		return "owner"
+	default:
+		return "unknown"
+	}
+}
+
+// sessionClient is a client attached to a session. The conn carries the pty
+// input and output while ctrl carries control messages (e.g., resizes).
+type sessionClient struct {
+	conn, ctrl net.Conn
+	user       string
+	mode       atomic.Int32
+	// Whether the client asked to be read-only
+	readOnly bool
+	// Whether the client only gets the output, without the attach response,
+	// and can't resume (e.g., SSH protocol clients). Set before attaching.
+	plain bool
+	// Guarded by the session's lock
+	size pty.Winsize
+	out  chan []byte
+	// Set before out is closed
+	exit *common.ExitStatus
+	// The client's resume slot, if resuming is enabled. Set before the client
+	// is served.
+	slot *resumeSlot
+	// Set if the client shouldn't be able to resume after being detached
+	noResume atomic.Bool
+	// Set once the client is being dropped for being too slow, after which no
+	// more output is queued for it
+	dropped atomic.Bool
+	// Whether the client is sent ActionEcho. Set before attaching.
+	echoEvents  bool
+	echoChanged chan utils.Unit
+	// Closed once the client's input is no longer read
+	inputDone chan utils.Unit
+
+	ctrlMtx   sync.Mutex
+	closeOnce sync.Once
+	done      chan utils.Unit
+}
+
+func newSessionClient(
+	conn, ctrl net.Conn,
+	user string,
+	mode clientMode,
+	readOnly bool,
+	sz *pty.Winsize,
+) *sessionClient {
+	c := &sessionClient{
+		conn:        conn,
+		ctrl:        ctrl,
+		user:        user,
+		readOnly:    readOnly,
+		size:        *sz,
+		out:         make(chan []byte, clientQueueLen),
+		echoChanged: make(chan utils.Unit, 1),
+		inputDone:   make(chan utils.Unit),
+		done:        make(chan utils.Unit),
+	}
+	c.mode.Store(int32(mode))
+	return c
+}
+
+func (c *sessionClient) getMode() clientMode {
+	return clientMode(c.mode.Load())
+}
+
+// queue queues the output to be written to the client, returning false if
+// the client's queue is full. Must be called with the session's lock held.
+func (c *sessionClient) queue(b []byte) bool {
+	select {
+	case c.out <- b:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeOutput writes queued output until the client is closed or the queue is
+// closed, in which case the client is sent the exit status and closed.
+func (c *sessionClient) writeOutput() {
+	for {
+		select {
+		case b, ok := <-c.out:
+			if !ok {
+				if c.exit != nil {
+					c.writeCtrl(
+						common.AppendExitStatus([]byte{common.ActionExit}, *c.exit),
+					)
+				}
+				c.close()
+				return
+			}
+			if _, err := utils.WriteAll(c.conn, b); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// sendClose tells the client the session is being closed and why. The client
+// won't be able to resume.
+func (c *sessionClient) sendClose(reason string) error {
+	c.noResume.Store(true)
+	return c.writeCtrl(common.AppendStr16([]byte{common.ActionClose}, reason))
+}
+
+func (c *sessionClient) writeCtrl(b []byte) error {
+	c.ctrlMtx.Lock()
+	defer c.ctrlMtx.Unlock()
+	_, err := utils.WriteAll(c.ctrl, b)
+	return err
+}
+
+func (c *sessionClient) close() {
+	c.closeOnce.Do(func() {
+		c.conn.Close()
+		c.ctrl.Close()
+		close(c.done)
+	})
+}
+
+// peerAddr returns the address of the remote end of the connection.
+func peerAddr(conn net.Conn) string {
+	if ws, ok := conn.(*webs.Conn); ok {
+		return ws.Request().RemoteAddr
+	} else if addr := conn.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+// ringBuf holds the last len(buf) bytes written to it.
+type ringBuf struct {
+	buf      []byte
+	start, n int
+	// The total number of bytes written
+	total uint64
+}
+
+func newRingBuf(size int) *ringBuf {
+	if size < 0 {
+		size = 0
+	}
+	return &ringBuf{buf: make([]byte, size)}
+}
+
+func (r *ringBuf) Write(p []byte) (int, error) {
+	l, size := len(p), len(r.buf)
+	r.total += uint64(l)
+	if size == 0 {
+		return l, nil
+	} else if l >= size {
+		copy(r.buf, p[l-size:])
+		r.start, r.n = 0, size
+		return l, nil
+	}
+	end := (r.start + r.n) % size
+	c := copy(r.buf[end:], p)
+	copy(r.buf, p[c:])
+	if r.n+l > size {
+		r.start = (r.start + r.n + l - size) % size
+		r.n = size
+	} else {
+		r.n += l
+	}
+	return l, nil
+}
+
+// Bytes returns a copy of the bytes held.
+func (r *ringBuf) Bytes() []byte {
+	b := make([]byte, r.n)
+	end := r.start + r.n
+	if end > len(r.buf) {
+		end = len(r.buf)
+	}
+	c := copy(b, r.buf[r.start:end])
+	copy(b[c:], r.buf[:r.n-c])
+	return b
+}
+
+// Since returns the bytes held starting at the given offset in the total
+// bytes written, along with the actual starting offset, which is later if
+// the bytes at the offset are no longer held.
+func (r *ringBuf) Since(offset uint64) (uint64, []byte) {
+	b := r.Bytes()
+	oldest := r.total - uint64(len(b))
+	if offset < oldest {
+		return oldest, b
+	} else if offset > r.total {
+		return r.total, nil
+	}
+	return offset, b[offset-oldest:]
+}
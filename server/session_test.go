@@ -0,0 +1,50 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/johnietre/gossh/common"
+)
+
+func TestAccessForForcedCommand(t *testing.T) {
+	alice := &User{Name: "alice"}
+	bob := &User{Name: "bob", ForceCommand: []string{"backup"}}
+	admin := &User{Name: "root", Admin: true, ForceCommand: []string{"backup"}}
+
+	shell := &sshSession{
+		id:     1,
+		user:   alice.Name,
+		shares: map[string]bool{bob.Name: true, admin.Name: true},
+	}
+	own := &sshSession{
+		id:     2,
+		user:   bob.Name,
+		forced: true,
+		shares: map[string]bool{},
+	}
+
+	tests := []struct {
+		name string
+		user *User
+		sess *sshSession
+		ok   bool
+	}{
+		{"owner of shell", alice, shell, true},
+		{"forced user on shared shell", bob, shell, false},
+		{"forced admin on shell", admin, shell, false},
+		{"forced user on own forced session", bob, own, true},
+		{"forced admin on other's forced session", admin, own, false},
+	}
+	for _, test := range tests {
+		_, err := test.sess.accessFor(test.user, false)
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !test.ok {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			} else if code := common.ErrorFrom(err).Code; code != common.RespErrPermission {
+				t.Errorf("%s: expected permission error, got code %d", test.name, code)
+			}
+		}
+	}
+}
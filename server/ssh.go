@@ -11,7 +11,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/creack/pty"
 	"github.com/johnietre/gossh/common"
 	utils "github.com/johnietre/utils/go"
 )
@@ -21,14 +20,14 @@ var (
 	idCounter atomic.Uint64
 )
 
-func handleSshConn(conn net.Conn) (wg *sync.WaitGroup) {
-	cmd := exec.Command(shell)
-	cmd.Dir = sshDir
-	return handleSshConnCmd(conn, cmd, cmd.Start, cmd.Wait)
+func handleSshConn(conn net.Conn, user *User) (wg *sync.WaitGroup) {
+	// The command is created once the request has been read
+	return handleSshConnCmd(conn, user, nil, nil, nil)
 }
 
 func handleSshConnCmd(
 	conn net.Conn,
+	user *User,
 	cmd *exec.Cmd,
 	start, wait func() error,
 ) (wg *sync.WaitGroup) {
@@ -46,18 +45,43 @@ func handleSshConnCmd(
 		return
 	}
 	if buf[0] == common.HeaderNewSsh {
+		var req common.SshReq
+		if err := common.ReadJsonFrame(conn, &req); err != nil {
+			common.WriteErrorMsg(conn, common.RespErrBadRequest, err.Error())
+			return
+		}
 		*closeConn = false
-		go handleOOB(cw, cmd, start, wait)
+		go handleOOB(cw, user, req, cmd, start, wait)
+		return
+	} else if buf[0] == common.HeaderListSsh {
+		handleSshConnListSessions(conn, user)
+		return
+	} else if buf[0] == common.HeaderKillSsh {
+		handleSshConnKillSession(conn, user)
+		return
+	} else if buf[0] == common.HeaderShareSsh {
+		handleSshConnShareSession(conn, user)
+		return
+	} else if buf[0] == common.HeaderExecSsh {
+		handleSshConnExec(conn, user)
 		return
 	} else if buf[0] != common.HeaderJoinSsh {
+		common.WriteErrorMsg(
+			conn, common.RespErrBadRequest,
+			fmt.Sprintf("unknown SSH header: %d", buf[0]),
+		)
 		return
 	}
-	if n, err := conn.Read(buf[:]); err != nil || n != 8 {
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
 		return
 	}
 	id := binary.LittleEndian.Uint64(buf[:])
 	ich, loaded := connChans.LoadAndDelete(id)
 	if !loaded {
+		common.WriteErrorMsg(
+			conn, common.RespErrNotExist,
+			fmt.Sprintf("no pending SSH connection with ID %d", id),
+		)
 		return
 	}
 	ch := ich.(chan *connWait)
@@ -75,6 +99,8 @@ type connWait struct {
 // out-of-band
 func handleOOB(
 	cw *connWait,
+	user *User,
+	req common.SshReq,
 	cmd *exec.Cmd,
 	start, wait func() error,
 ) {
@@ -84,7 +110,7 @@ func handleOOB(
 	var other *connWait
 
 	id := idCounter.Add(1)
-	idBytes := binary.LittleEndian.AppendUint64(nil, id)
+	idBytes := binary.LittleEndian.AppendUint64([]byte{common.RespOk}, id)
 	if _, err := conn.Write(idBytes); err != nil {
 		return
 	}
@@ -94,8 +120,11 @@ func handleOOB(
 	select {
 	case <-timer.C:
 		_, loaded := connChans.LoadAndDelete(id)
-		// TODO: Send timed out?
 		if loaded {
+			common.WriteErrorMsg(
+				conn, common.RespErrTimeout,
+				"timed out waiting for control connection",
+			)
 			return
 		} else if other, _ = <-ch; other == nil {
 			return
@@ -113,60 +142,91 @@ func handleOOB(
 	} else if _, err := other.Write(idBytes); err != nil {
 		return
 	}
-	if n, err := other.Read(idBytes); err != nil || n != 8 {
+	if _, err := io.ReadFull(other, idBytes[:8]); err != nil {
 		return
 	}
-	sz := common.WinsizeFromBytes(idBytes)
+	sz := common.WinsizeFromBytes(idBytes[:8])
 
-	pf, tf, err := pty.Open()
-	if err != nil || pf == nil || tf == nil {
+	var sess *sshSession
+	var err error
+	mode := clientOwner
+	if req.Resume != "" {
+		var slot *resumeSlot
+		slot, err = findResumeSlot(user, req.Resume)
 		if err == nil {
-			err = fmt.Errorf("files returned were nil")
+			sess = slot.sess
+			mode, err = sess.accessFor(user, slot.readOnly)
 		}
-		conn.Write([]byte(err.Error()))
-		log.Print("Error starting program: ", err)
-		return
-	}
-	defer pf.Close()
-	defer tf.Close()
-
-	cmd.Stdin, cmd.Stdout, cmd.Stderr = tf, tf, tf
-	f, err := startWithSize(cmd, &sz, start)
-	if err != nil || f == nil {
 		if err == nil {
-			err = fmt.Errorf("file returned was nil")
+			c := newSessionClient(conn, other, user.Name, mode, slot.readOnly, &sz)
+			c.echoEvents = req.EchoEvents
+			err = sess.resume(c, slot, req.Offset)
+		}
+		if err != nil {
+			common.WriteError(conn, err)
 		}
-		conn.Write([]byte(err.Error()))
-		log.Printf("Error starting %s: %v", cmd.Path, err)
 		return
-	}
-	defer f.Close()
-	pty.Setsize(tf, &sz)
-
-	go io.Copy(conn, pf)
-	go io.Copy(pf, conn)
-	go func() {
-		var buf [128]byte
-		for {
-			_, err := other.Read(buf[:1])
-			if err != nil {
-				break
+	} else if req.Attach != "" {
+		sess, err = findSession(req.Attach)
+		if err == nil {
+			mode, err = sess.accessFor(user, req.ReadOnly)
+		}
+	} else {
+		var motd []byte
+		if cmd == nil {
+			if cmd, err = newShellCmd(user, req); err == nil {
+				start, wait = cmd.Start, cmd.Wait
 			}
-			if buf[0] == common.ActionResize {
-				n, err := other.Read(buf[:8])
-				if err != nil || n != 8 {
-					// TODO
-					break
-				}
-				ws := common.WinsizeFromBytes(buf[:8])
-				if err := pty.Setsize(tf, &ws); err != nil {
-					// TODO
-				}
+			if len(req.Command) == 0 && len(user.ForceCommand) == 0 {
+				motd = recordLogin(user, peerAddr(conn))
+			}
+		}
+		if err == nil {
+			sess, err = startSession(id, user, req, cmd, &sz, motd, start, wait)
+			if err != nil {
+				log.Printf("Error starting %s: %v", cmd.Path, err)
 			}
 		}
-		other.Close()
-	}()
-	if err := wait(); err != nil {
-		log.Print("Error waiting: ", err)
 	}
+	if err == nil {
+		c := newSessionClient(conn, other, user.Name, mode, req.ReadOnly, &sz)
+		c.echoEvents = req.EchoEvents
+		err = sess.attach(c, req.DetachOthers)
+	}
+	if err != nil {
+		common.WriteError(conn, err)
+	}
+}
+
+func handleSshConnListSessions(conn net.Conn, user *User) {
+	if _, err := conn.Write([]byte{common.RespOk}); err != nil {
+		return
+	}
+	common.WriteJsonFrame(conn, listSessions(user))
+}
+
+func handleSshConnKillSession(conn net.Conn, user *User) {
+	var req common.KillSessionReq
+	if err := common.ReadJsonFrame(conn, &req); err != nil {
+		common.WriteErrorMsg(conn, common.RespErrBadRequest, err.Error())
+		return
+	}
+	if err := killSession(user, req); err != nil {
+		common.WriteError(conn, err)
+		return
+	}
+	conn.Write([]byte{common.RespOk})
+}
+
+func handleSshConnShareSession(conn net.Conn, user *User) {
+	var req common.ShareSessionReq
+	if err := common.ReadJsonFrame(conn, &req); err != nil {
+		common.WriteErrorMsg(conn, common.RespErrBadRequest, err.Error())
+		return
+	}
+	if err := shareSession(user, req); err != nil {
+		common.WriteError(conn, err)
+		return
+	}
+	conn.Write([]byte{common.RespOk})
 }
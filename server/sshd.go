@@ -0,0 +1,524 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/johnietre/gossh/common"
+	utils "github.com/johnietre/utils/go"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	sshListenAddr, sshHostKeyPath, sftpServerPath string
+
+	// Paths to look for sftp-server at if --sftp-server isn't set
+	sftpServerPaths = []string{
+		"/usr/lib/openssh/sftp-server",
+		"/usr/libexec/openssh/sftp-server",
+		"/usr/lib/ssh/sftp-server",
+		"/usr/libexec/sftp-server",
+	}
+)
+
+// runSshd accepts SSH protocol connections, so standard ssh clients can be
+// used, until the listener fails.
+func runSshd(addr string) error {
+	hostKey, err := loadHostKey(sshHostKeyPath)
+	if err != nil {
+		return fmt.Errorf("error loading host key: %w", err)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	log.Printf("Listening for SSH protocol connections on %s", ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go handleSshdConn(conn, hostKey)
+	}
+}
+
+// loadHostKey loads the host key from the path, generating a new key and
+// saving it there if it doesn't exist.
+func loadHostKey(path string) (ssh.Signer, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(key, "gossh host key")
+		if err != nil {
+			return nil, err
+		}
+		b = pem.EncodeToMemory(block)
+		if err := os.WriteFile(path, b, 0600); err != nil {
+			return nil, err
+		}
+		log.Printf("Generated SSH host key at %s", path)
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(b)
+}
+
+func handleSshdConn(conn net.Conn, hostKey ssh.Signer) {
+	var user *User
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(
+			md ssh.ConnMetadata, pwd []byte,
+		) (*ssh.Permissions, error) {
+			u, err := authenticate(md.User(), pwd)
+			if err != nil {
+				if errors.Is(err, common.ErrPasswordError) {
+					log.Print("error checking password: ", err)
+				}
+				return nil, err
+			} else if !u.allows(common.TcpSsh) {
+				return nil, errServiceDenied(common.TcpSsh)
+			}
+			user = u
+			return nil, nil
+		},
+	}
+	if banner != "" {
+		config.BannerCallback = func(ssh.ConnMetadata) string {
+			return banner
+		}
+	}
+	config.AddHostKey(hostKey)
+
+	conn.SetDeadline(time.Now().Add(time.Second * 30))
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	defer sconn.Close()
+	log.Printf("%s connected over SSH from %s", user.Name, sconn.RemoteAddr())
+
+	go ssh.DiscardRequests(reqs)
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		ch, reqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		s := &sshdSession{
+			sconn: sconn,
+			user:  user,
+			ch:    ch,
+			env:   make(map[string]string),
+			gone:  make(chan utils.Unit),
+		}
+		go s.handleRequests(reqs)
+	}
+}
+
+// sshdSession is a session channel of an SSH protocol connection.
+type sshdSession struct {
+	sconn *ssh.ServerConn
+	user  *User
+	ch    ssh.Channel
+	env   map[string]string
+	// Set if a pty was requested
+	size *pty.Winsize
+	// Set once a session with a pty is started
+	ctrl *chanCtrl
+	// Signals what was started, set once it's started
+	signal func(syscall.Signal)
+	// Closed once the client has closed the channel
+	gone chan utils.Unit
+}
+
+type sshdPtyReq struct {
+	Term                      string
+	Cols, Rows, Width, Height uint32
+	Modes                     string
+}
+
+type sshdWinChange struct {
+	Cols, Rows, Width, Height uint32
+}
+
+func (s *sshdSession) handleRequests(reqs <-chan *ssh.Request) {
+	defer close(s.gone)
+	started := false
+	for req := range reqs {
+		ok := false
+		switch req.Type {
+		case "env":
+			var kv struct{ Name, Value string }
+			if ssh.Unmarshal(req.Payload, &kv) == nil && !started {
+				s.env[kv.Name], ok = kv.Value, true
+			}
+		case "pty-req":
+			var pr sshdPtyReq
+			if ssh.Unmarshal(req.Payload, &pr) == nil && !started {
+				s.size = sshdWinsize(pr.Cols, pr.Rows, pr.Width, pr.Height)
+				if pr.Term != "" {
+					s.env["TERM"] = pr.Term
+				}
+				ok = true
+			}
+		case "window-change":
+			var wc sshdWinChange
+			if ssh.Unmarshal(req.Payload, &wc) == nil {
+				sz := sshdWinsize(wc.Cols, wc.Rows, wc.Width, wc.Height)
+				if s.ctrl != nil {
+					s.ctrl.resize(sz)
+				} else if s.size != nil {
+					s.size = sz
+				}
+				ok = true
+			}
+		case "signal":
+			var p struct{ Signal string }
+			if ssh.Unmarshal(req.Payload, &p) == nil && s.signal != nil {
+				for sig, name := range common.SignalNames {
+					if name == p.Signal {
+						s.signal(sig)
+						ok = true
+						break
+					}
+				}
+			}
+		case "shell", "exec", "subsystem":
+			if started {
+				break
+			}
+			run, err := s.start(req)
+			if err != nil {
+				fmt.Fprintf(s.ch.Stderr(), "gossh: %v\r\n", err)
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+				s.ch.Close()
+				continue
+			}
+			started, ok = true, true
+			if req.WantReply {
+				req.Reply(true, nil)
+			}
+			go run()
+			continue
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+}
+
+// start starts what the request asks for, returning a function which serves
+// the client until it's done.
+func (s *sshdSession) start(req *ssh.Request) (func(), error) {
+	var command []string
+	var original string
+	switch req.Type {
+	case "exec":
+		var p struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &p); err != nil {
+			return nil, err
+		}
+		command, original = []string{s.user.shellArgs()[0], "-c", p.Command}, p.Command
+	case "subsystem":
+		var p struct{ Name string }
+		if err := ssh.Unmarshal(req.Payload, &p); err != nil {
+			return nil, err
+		} else if p.Name != "sftp" {
+			return nil, fmt.Errorf("unsupported subsystem: %s", p.Name)
+		} else if !s.user.allows(common.TcpFiles) {
+			return nil, errServiceDenied(common.TcpFiles)
+		}
+		path := findSftpServer()
+		if path == "" {
+			return nil, fmt.Errorf("sftp-server not found")
+		}
+		command, original = []string{path}, p.Name
+	}
+	cmd, err := newCmd(s.user, command, original, s.env, "", s.size != nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.size != nil {
+		var motd []byte
+		if req.Type == "shell" && len(s.user.ForceCommand) == 0 {
+			motd = recordLogin(s.user, s.sconn.RemoteAddr().String())
+		}
+		return s.startSession(cmd, motd)
+	}
+	return s.startExec(cmd)
+}
+
+// startSession starts the command in a session, which the channel is
+// attached to, so it's managed like any other session.
+func (s *sshdSession) startSession(
+	cmd *exec.Cmd, motd []byte,
+) (func(), error) {
+	sess, err := startSession(
+		idCounter.Add(1), s.user, common.SshReq{Env: s.env},
+		cmd, s.size, motd, cmd.Start, cmd.Wait,
+	)
+	if err != nil {
+		log.Printf("Error starting %s: %v", cmd.Path, err)
+		return nil, err
+	}
+	s.ctrl = newChanCtrl(s.ch)
+	s.signal = sess.signal
+	conn := &chanConn{
+		Channel: s.ch,
+		sconn:   s.sconn,
+		gone:    s.gone,
+		closed:  make(chan utils.Unit),
+	}
+	c := newSessionClient(conn, s.ctrl, s.user.Name, clientOwner, false, s.size)
+	c.plain = true
+	return func() {
+		if err := sess.attach(c, false); err != nil {
+			fmt.Fprintf(s.ch.Stderr(), "gossh: %v\r\n", err)
+			s.ch.Close()
+		}
+	}, nil
+}
+
+// startExec starts the command without a pty, with its stdout and stderr
+// going to the channel's stdout and stderr.
+func (s *sshdSession) startExec(cmd *exec.Cmd) (func(), error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	log.Printf("%s executing %q over SSH", s.user.Name, cmd.Args)
+	exited := make(chan utils.Unit)
+	s.signal = func(sig syscall.Signal) {
+		select {
+		case <-exited:
+		default:
+			signalGroup(cmd.Process, sig)
+		}
+	}
+	return func() {
+		go func() {
+			io.Copy(stdin, s.ch)
+			stdin.Close()
+		}()
+		go func() {
+			select {
+			case <-s.gone:
+				// The client is gone
+				s.signal(syscall.SIGKILL)
+			case <-exited:
+			}
+		}()
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			io.Copy(s.ch, stdout)
+			wg.Done()
+		}()
+		go func() {
+			io.Copy(s.ch.Stderr(), stderr)
+			wg.Done()
+		}()
+		wg.Wait()
+		cmd.Wait()
+		close(exited)
+		sendExitStatus(s.ch, common.ExitStatusFromState(cmd.ProcessState))
+		s.ch.CloseWrite()
+		s.ch.Close()
+	}, nil
+}
+
+func findSftpServer() string {
+	if sftpServerPath != "" {
+		return sftpServerPath
+	}
+	for _, path := range sftpServerPaths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+func sshdWinsize(cols, rows, width, height uint32) *pty.Winsize {
+	return &pty.Winsize{
+		Rows: uint16(rows),
+		Cols: uint16(cols),
+		X:    uint16(width),
+		Y:    uint16(height),
+	}
+}
+
+func sendExitStatus(ch ssh.Channel, es common.ExitStatus) {
+	if name, ok := common.SignalNames[syscall.Signal(es.Signal)]; ok {
+		ch.SendRequest("exit-signal", false, ssh.Marshal(struct {
+			Signal     string
+			CoreDumped bool
+			Error      string
+			Lang       string
+		}{Signal: name}))
+		return
+	}
+	code := es.Code
+	if es.Signal != 0 {
+		code = 128 + es.Signal
+	}
+	ch.SendRequest("exit-status", false, ssh.Marshal(struct {
+		Status uint32
+	}{uint32(code)}))
+}
+
+// chanConn adapts a channel to a net.Conn so it can be used as a session
+// client's connection.
+type chanConn struct {
+	ssh.Channel
+	sconn *ssh.ServerConn
+	// Closed once the client has closed the channel
+	gone      <-chan utils.Unit
+	closed    chan utils.Unit
+	closeOnce sync.Once
+}
+
+func (c *chanConn) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	if err == io.EOF {
+		// The client may have only closed its input, which shouldn't detach it
+		select {
+		case <-c.gone:
+		case <-c.closed:
+		}
+	}
+	return n, err
+}
+
+func (c *chanConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	c.Channel.CloseWrite()
+	return c.Channel.Close()
+}
+
+func (c *chanConn) LocalAddr() net.Addr {
+	return c.sconn.LocalAddr()
+}
+
+func (c *chanConn) RemoteAddr() net.Addr {
+	return c.sconn.RemoteAddr()
+}
+
+func (c *chanConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c *chanConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c *chanConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// chanCtrl acts as a session client's control connection for a channel,
+// turning window changes into resize actions and close and exit actions into
+// the corresponding channel messages.
+type chanCtrl struct {
+	ch ssh.Channel
+	pr *io.PipeReader
+	pw *io.PipeWriter
+}
+
+func newChanCtrl(ch ssh.Channel) *chanCtrl {
+	pr, pw := io.Pipe()
+	return &chanCtrl{ch: ch, pr: pr, pw: pw}
+}
+
+func (c *chanCtrl) resize(sz *pty.Winsize) {
+	b := make([]byte, 9)
+	b[0] = common.ActionResize
+	common.WinsizeToBytes(b[1:], sz)
+	c.pw.Write(b)
+}
+
+func (c *chanCtrl) Read(p []byte) (int, error) {
+	return c.pr.Read(p)
+}
+
+// Write handles an action. Each action must be written in a single call.
+func (c *chanCtrl) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	switch b[0] {
+	case common.ActionClose:
+		if reason, err := common.ReadStr16(bytes.NewReader(b[1:])); err == nil {
+			fmt.Fprintf(c.ch.Stderr(), "\r\ngossh: session closed: %s\r\n", reason)
+		}
+	case common.ActionExit:
+		if es, err := common.ReadExitStatus(bytes.NewReader(b[1:])); err == nil {
+			sendExitStatus(c.ch, es)
+		}
+	}
+	return len(b), nil
+}
+
+func (c *chanCtrl) Close() error {
+	c.pr.Close()
+	return c.pw.Close()
+}
+
+func (c *chanCtrl) LocalAddr() net.Addr {
+	return nil
+}
+
+func (c *chanCtrl) RemoteAddr() net.Addr {
+	return nil
+}
+
+func (c *chanCtrl) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c *chanCtrl) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c *chanCtrl) SetWriteDeadline(time.Time) error {
+	return nil
+}
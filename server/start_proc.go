@@ -10,6 +10,7 @@ import (
 	"syscall"
 
 	ptypkg "github.com/creack/pty"
+	"golang.org/x/sys/unix"
 )
 
 func startWithSize(
@@ -61,3 +62,55 @@ func startWithAttrs(
 	}
 	return pty, err
 }
+
+// setProcessGroup makes the command start in a new process group so it can be
+// signaled with signalGroup.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalGroup sends the signal to the process group led by the process.
+func signalGroup(p *os.Process, sig syscall.Signal) error {
+	return syscall.Kill(-p.Pid, sig)
+}
+
+// signalPty sends the signal to the foreground process group of the pty, as
+// the terminal would for Ctrl-C, or the command's process group if it can't be
+// gotten.
+func signalPty(cmd *exec.Cmd, f *os.File, sig syscall.Signal) error {
+	pgrp := -1
+	if rc, err := f.SyscallConn(); err == nil {
+		rc.Control(func(fd uintptr) {
+			if id, err := unix.IoctlGetInt(int(fd), unix.TIOCGPGRP); err == nil {
+				pgrp = id
+			}
+		})
+	}
+	if pgrp <= 0 {
+		return signalGroup(cmd.Process, sig)
+	}
+	return syscall.Kill(-pgrp, sig)
+}
+
+// ptyEchoes returns whether the pty echoes typed input. Input isn't considered
+// echoed when echo is off in canonical mode, which is how passwords are read,
+// but programs using raw mode are assumed to echo input themselves.
+func ptyEchoes(f *os.File) (bool, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return true, err
+	}
+	var termios *unix.Termios
+	err2 := rc.Control(func(fd uintptr) {
+		termios, err = unix.IoctlGetTermios(int(fd), ioctlReadTermios)
+	})
+	if err2 != nil {
+		return true, err2
+	} else if err != nil {
+		return true, err
+	}
+	return termios.Lflag&unix.ECHO != 0 || termios.Lflag&unix.ICANON == 0, nil
+}
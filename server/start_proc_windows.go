@@ -6,6 +6,7 @@ package server
 import (
 	"os"
 	"os/exec"
+	"syscall"
 
 	"github.com/creack/pty"
 )
@@ -17,3 +18,20 @@ func startWithSize(
 ) (*os.File, error) {
 	return nil, pty.ErrUnsupported
 }
+
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// signalGroup sends the signal to the process, process groups not being
+// supported.
+func signalGroup(p *os.Process, sig syscall.Signal) error {
+	return p.Signal(sig)
+}
+
+func signalPty(cmd *exec.Cmd, f *os.File, sig syscall.Signal) error {
+	return signalGroup(cmd.Process, sig)
+}
+
+func ptyEchoes(f *os.File) (bool, error) {
+	return true, pty.ErrUnsupported
+}
@@ -1,8 +1,10 @@
 package server
 
 import (
-	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"log"
 	"net"
 
 	"github.com/johnietre/gossh/common"
@@ -28,56 +30,70 @@ func handleTcp(conn net.Conn) {
 		return
 	}
 
-	if !checkTcpPassword(conn) {
+	if buf[0] == common.TcpBanner {
+		utils.WriteAll(conn, common.AppendStr16(nil, banner))
+		return
+	}
+
+	user, ok := checkTcpPassword(conn, buf[0])
+	if !ok {
 		return
 	}
 
 	*shouldClose = false
 	switch buf[0] {
 	case common.TcpSsh:
-		handleSshConn(conn)
+		handleSshConn(conn, user)
 	case common.TcpFiles:
 		handleFilesConn(conn)
 	case common.TcpProcs:
-		handleProcsConn(conn)
+		handleProcsConn(conn, user)
+	case common.TcpForward:
+		handleForwardConn(conn, user)
 	default:
-		// TODO
+		common.WriteErrorMsg(
+			conn, common.RespErrBadRequest,
+			fmt.Sprintf("unknown connection type: %d", buf[0]),
+		)
 		*shouldClose = true
 	}
 }
 
-func checkTcpPassword(conn net.Conn) bool {
-	var buf [8]byte
+// checkTcpPassword reads the username and password and authenticates the
+// user, checking that they can use the service for the connection type and
+// sending the response.
+func checkTcpPassword(conn net.Conn, what byte) (*User, bool) {
+	var buf [1]byte
+	// Read username
+	if _, err := conn.Read(buf[:1]); err != nil {
+		return nil, false
+	}
+	nameBytes := make([]byte, int(buf[0]))
+	if _, err := io.ReadFull(conn, nameBytes); err != nil {
+		return nil, false
+	}
 	// Read password
 	if _, err := conn.Read(buf[:1]); err != nil {
-		return false
+		return nil, false
 	}
-	pwdLen := int(buf[0])
-	pwdBytes := make([]byte, pwdLen)
+	pwdBytes := make([]byte, int(buf[0]))
 	if _, err := io.ReadFull(conn, pwdBytes); err != nil {
-		return false
+		return nil, false
 	}
-	if ok, err := checkPassword(pwdBytes); err != nil {
-		conn.Write([]byte{common.RespErrPasswordError})
-		return false
-	} else if !ok {
-		conn.Write([]byte{common.RespErrPasswordInvalid})
-		return false
+	user, err := authenticate(string(nameBytes), pwdBytes)
+	if err != nil {
+		if errors.Is(err, common.ErrPasswordError) {
+			log.Print("error checking password: ", err)
+		}
+		common.WriteError(conn, err)
+		return nil, false
 	}
-	if _, err := conn.Write([]byte{common.RespOk}); err != nil {
-		return false
+	if !user.allows(what) {
+		common.WriteError(conn, errServiceDenied(what))
+		return nil, false
 	}
-	return true
-}
-
-func writeConnRespMsg(conn net.Conn, what byte, msg string) error {
-	if len(msg) > 1<<16-1 {
-		msg = msg[:1<<16-1]
+	if _, err := conn.Write([]byte{common.RespOk}); err != nil {
+		return nil, false
 	}
-	bytes := append(
-		binary.LittleEndian.AppendUint16([]byte{what}, uint16(len(msg))),
-		msg...,
-	)
-	_, err := utils.WriteAll(conn, bytes)
-	return err
+	return user, true
 }
@@ -0,0 +1,8 @@
+//go:build aix || linux || solaris || zos
+// +build aix linux solaris zos
+
+package server
+
+import "golang.org/x/sys/unix"
+
+const ioctlReadTermios = unix.TCGETS
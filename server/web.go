@@ -0,0 +1,32 @@
+package server
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+var (
+	serveWeb bool
+
+	//go:embed web
+	webFS embed.FS
+)
+
+// webVendored returns whether the web terminal's dependencies were vendored
+// when the server was built.
+func webVendored() bool {
+	_, err := fs.Stat(webFS, "web/vendor/xterm.mjs")
+	return err == nil
+}
+
+// webHandler serves the embedded web terminal, which is expected to be
+// mounted at /web/. Its dependencies are vendored in web/vendor (see the
+// makefile's web-vendor target) so it's served entirely by the server.
+func webHandler() http.Handler {
+	sub, err := fs.Sub(webFS, "web")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/web/", http.FileServer(http.FS(sub)))
+}
@@ -0,0 +1,367 @@
+// Web terminal for gossh. It speaks the same protocol as the CLI over two
+// websockets to /ws/ssh: the main connection carries the session's input and
+// output and the control connection carries resizes and session events.
+// xterm.js and its fit addon are vendored (see "make web-vendor").
+import { Terminal } from "./vendor/xterm.mjs";
+import { FitAddon } from "./vendor/addon-fit.mjs";
+
+const RespOk = 1;
+const RespErr = 128;
+const HeaderNewSsh = 1;
+const HeaderJoinSsh = 2;
+const ActionResize = 3;
+const ActionClose = 6;
+const ActionExit = 8;
+const ActionDetach = 10;
+
+const codeNames = {
+  128: "error",
+  129: "does not exist",
+  130: "password invalid",
+  131: "password error",
+  132: "bad request",
+  133: "timed out",
+  134: "unsupported",
+  135: "permission denied",
+};
+
+const encoder = new TextEncoder();
+const decoder = new TextDecoder();
+
+const statusElem = document.getElementById("status");
+const loginForm = document.getElementById("login");
+const errorElem = document.getElementById("error");
+const termElem = document.getElementById("terminal");
+const disconnectBtn = document.getElementById("disconnect");
+const bannerElem = document.getElementById("banner");
+
+let term = null;
+let fitAddon = null;
+let session = null;
+
+class GosshError extends Error {
+  constructor(code, message, details) {
+    let s = codeNames[code] ?? `error code ${code}`;
+    if (message) {
+      s += `: ${message}`;
+    }
+    if (details) {
+      s += ` (${details})`;
+    }
+    super(s);
+    this.code = code;
+  }
+}
+
+// Conn wraps a websocket, buffering received data so protocol fields can be
+// read regardless of how they were split into messages.
+class Conn {
+  constructor(url) {
+    this.ws = new WebSocket(url);
+    this.ws.binaryType = "arraybuffer";
+    this.buf = new Uint8Array(0);
+    this.waiters = [];
+    this.onData = null;
+    this.closed = new Promise((resolve) => {
+      this.ws.addEventListener("close", () => {
+        this.isClosed = true;
+        this.wake();
+        resolve();
+      });
+    });
+    this.ws.addEventListener("message", (ev) => {
+      const data = typeof ev.data === "string"
+        ? encoder.encode(ev.data)
+        : new Uint8Array(ev.data);
+      this.push(data);
+    });
+  }
+
+  open() {
+    return new Promise((resolve, reject) => {
+      this.ws.addEventListener("open", resolve);
+      this.ws.addEventListener("error", () => reject(new Error("error connecting")));
+    });
+  }
+
+  push(data) {
+    if (this.onData) {
+      this.onData(data);
+      return;
+    }
+    const b = new Uint8Array(this.buf.length + data.length);
+    b.set(this.buf);
+    b.set(data, this.buf.length);
+    this.buf = b;
+    this.wake();
+  }
+
+  wake() {
+    const waiters = this.waiters;
+    this.waiters = [];
+    waiters.forEach((f) => f());
+  }
+
+  async read(n) {
+    while (this.buf.length < n) {
+      if (this.isClosed) {
+        throw new Error("connection closed");
+      }
+      await new Promise((resolve) => this.waiters.push(resolve));
+    }
+    const b = this.buf.slice(0, n);
+    this.buf = this.buf.slice(n);
+    return b;
+  }
+
+  async readU8() {
+    return (await this.read(1))[0];
+  }
+
+  async readU64() {
+    const b = await this.read(8);
+    return new DataView(b.buffer).getBigUint64(0, true);
+  }
+
+  async readStr16() {
+    const b = await this.read(2);
+    const n = new DataView(b.buffer).getUint16(0, true);
+    return decoder.decode(await this.read(n));
+  }
+
+  // readResp reads a response, throwing a GosshError if an error was sent.
+  async readResp() {
+    const code = await this.readU8();
+    if (code === RespOk) {
+      return;
+    } else if (code < RespErr) {
+      throw new Error(`received unknown response: ${code}`);
+    }
+    const message = await this.readStr16();
+    const details = await this.readStr16();
+    throw new GosshError(code, message, details);
+  }
+
+  // stream passes all data, starting with what's buffered, to onData rather
+  // than buffering it.
+  stream(onData) {
+    this.onData = onData;
+    if (this.buf.length !== 0) {
+      const b = this.buf;
+      this.buf = new Uint8Array(0);
+      onData(b);
+    }
+  }
+
+  send(...parts) {
+    if (this.ws.readyState === WebSocket.OPEN) {
+      this.ws.send(concat(...parts));
+    }
+  }
+
+  close() {
+    this.ws.close();
+  }
+}
+
+function concat(...parts) {
+  const arrs = parts.map((p) => p instanceof Uint8Array ? p : new Uint8Array(p));
+  const b = new Uint8Array(arrs.reduce((n, a) => n + a.length, 0));
+  let i = 0;
+  for (const a of arrs) {
+    b.set(a, i);
+    i += a.length;
+  }
+  return b;
+}
+
+function str8(s) {
+  const b = encoder.encode(s);
+  if (b.length > 255) {
+    throw new Error("user and password must be at most 255 bytes");
+  }
+  return concat([b.length], b);
+}
+
+function jsonFrame(v) {
+  const b = encoder.encode(JSON.stringify(v));
+  const l = new Uint8Array(8);
+  new DataView(l.buffer).setBigUint64(0, BigInt(b.length), true);
+  return concat(l, b);
+}
+
+function winsize(rows, cols) {
+  const b = new Uint8Array(8);
+  const dv = new DataView(b.buffer);
+  dv.setUint16(0, rows, true);
+  dv.setUint16(2, cols, true);
+  return b;
+}
+
+function setStatus(state, text) {
+  statusElem.className = `status ${state}`;
+  statusElem.textContent = text;
+}
+
+function showLogin(err) {
+  errorElem.hidden = !err;
+  errorElem.textContent = err ? err.message : "";
+  loginForm.hidden = false;
+  disconnectBtn.hidden = true;
+}
+
+function wsUrl() {
+  const proto = location.protocol === "https:" ? "wss:" : "ws:";
+  return `${proto}//${location.host}/ws/ssh`;
+}
+
+// openConn opens a connection and logs in.
+async function openConn(user, password) {
+  const conn = new Conn(wsUrl());
+  try {
+    await conn.open();
+    conn.send(str8(user), str8(password));
+    await conn.readResp();
+  } catch (e) {
+    conn.close();
+    throw e;
+  }
+  return conn;
+}
+
+function initTerm() {
+  if (term !== null) {
+    return;
+  }
+  term = new Terminal({ cursorBlink: true, scrollback: 5000 });
+  fitAddon = new FitAddon();
+  term.loadAddon(fitAddon);
+  term.open(termElem);
+  window.addEventListener("resize", () => fitAddon.fit());
+}
+
+async function connect(user, password, attach) {
+  setStatus("connecting", "Connecting...");
+  loginForm.hidden = true;
+  termElem.hidden = false;
+  initTerm();
+  fitAddon.fit();
+
+  let main = null;
+  let ctrl = null;
+  try {
+    main = await openConn(user, password);
+    const req = { env: { TERM: "xterm-256color", COLORTERM: "truecolor" } };
+    if (attach) {
+      req.attach = attach;
+    }
+    main.send([HeaderNewSsh], jsonFrame(req));
+    await main.readResp();
+    const id = await main.read(8);
+
+    ctrl = await openConn(user, password);
+    ctrl.send([HeaderJoinSsh], id);
+    await main.readResp();
+    await main.read(8);
+    await ctrl.readResp();
+    await ctrl.read(8);
+
+    ctrl.send(winsize(term.rows, term.cols));
+    await main.readResp();
+    const sessId = await main.readU64();
+    // The output offset, resume token, and input received aren't needed since
+    // the page doesn't resume lost connections.
+    await main.read(8);
+    await main.readStr16();
+    await main.read(8);
+    run(main, ctrl, sessId);
+  } catch (e) {
+    main?.close();
+    ctrl?.close();
+    termElem.hidden = true;
+    setStatus("disconnected", "Disconnected");
+    showLogin(e);
+  }
+}
+
+function run(main, ctrl, sessId) {
+  const state = { main, ctrl, reason: null, exit: null };
+  session = state;
+  setStatus("connected", `Connected to session ${sessId}`);
+  disconnectBtn.hidden = false;
+
+  const disposables = [
+    term.onData((s) => main.send(encoder.encode(s))),
+    term.onBinary((s) => main.send(Uint8Array.from(s, (c) => c.charCodeAt(0)))),
+    term.onResize(({ rows, cols }) => ctrl.send([ActionResize], winsize(rows, cols))),
+  ];
+  main.stream((data) => term.write(data));
+  readCtrl(state).catch(() => {});
+  term.focus();
+
+  Promise.race([main.closed, ctrl.closed]).then(async () => {
+    main.close();
+    // Give the control connection a moment to deliver why the session ended.
+    await Promise.race([
+      ctrl.closed,
+      new Promise((resolve) => setTimeout(resolve, 1000)),
+    ]);
+    ctrl.close();
+    disposables.forEach((d) => d.dispose());
+    session = null;
+
+    let text = "Disconnected";
+    if (state.exit !== null) {
+      text = state.exit.signal !== 0
+        ? `Session killed by signal ${state.exit.signal}`
+        : `Session exited with code ${state.exit.code}`;
+    } else if (state.reason !== null) {
+      text = `Disconnected: ${state.reason}`;
+    }
+    setStatus("disconnected", text);
+    term.write(`\r\n[${text}]\r\n`);
+    showLogin(null);
+  });
+}
+
+async function readCtrl(state) {
+  for (;;) {
+    const action = await state.ctrl.readU8();
+    if (action === ActionClose) {
+      state.reason = await state.ctrl.readStr16();
+    } else if (action === ActionExit) {
+      const b = await state.ctrl.read(5);
+      const code = new DataView(b.buffer).getInt32(0, true);
+      state.exit = { code, signal: b[4] };
+    }
+  }
+}
+
+// detach tells the server the disconnect is intentional so it doesn't keep
+// the client's place in the session.
+function detach() {
+  if (session !== null) {
+    session.ctrl.send([ActionDetach]);
+    session.main.close();
+    session.ctrl.close();
+  }
+}
+
+async function loadBanner() {
+  const resp = await fetch("/banner");
+  const text = resp.ok ? await resp.text() : "";
+  if (text) {
+    bannerElem.textContent = text;
+    bannerElem.hidden = false;
+  }
+}
+
+loginForm.addEventListener("submit", (ev) => {
+  ev.preventDefault();
+  const data = new FormData(loginForm);
+  connect(data.get("user"), data.get("password"), data.get("attach").trim());
+});
+
+disconnectBtn.addEventListener("click", detach);
+window.addEventListener("beforeunload", detach);
+loadBanner().catch(() => {});